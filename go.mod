@@ -2,9 +2,16 @@ module github.com/geohot/minikeyvalue
 
 go 1.17
 
-require github.com/syndtr/goleveldb v1.0.0
+require (
+	github.com/google/uuid v1.3.0
+	github.com/klauspost/compress v1.15.15
+	github.com/klauspost/reedsolomon v1.9.3
+	github.com/syndtr/goleveldb v1.0.0
+	lukechampine.com/blake3 v1.1.7
+)
 
 require (
 	github.com/golang/snappy v0.0.0-20180518054509-2e65f85255db // indirect
-	github.com/google/uuid v1.3.0 // indirect
+	github.com/klauspost/cpuid v1.3.1 // indirect
+	github.com/klauspost/cpuid/v2 v2.0.9 // indirect
 )
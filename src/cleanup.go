@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// *** Cleanup ***
+
+// deletes the files a failed write left on the volumes
+// the ones that can't be deleted now are queued, and the cleaner deletes them later
+// the key is where the record of the files would be in the database, and must be locked
+func (a *App) DeleteFiles(key []byte, remotes []string) bool {
+	var failed []string
+	for _, remote := range remotes {
+		if err := remote_delete(remote); err != nil {
+			fmt.Println("cleanup delete error", err, remote)
+			failed = append(failed, remote)
+		}
+	}
+	if len(failed) == 0 {
+		return true
+	}
+
+	// another failed write of the key in the same second has the same entry
+	ckey := time2key(cleanupPrefix, time.Now().Unix(), key)
+	if data, err := a.db.Get(ckey, nil); err == nil {
+		failed = append(failed, strings.Split(string(data), "\n")...)
+	}
+	if err := a.db.Put(ckey, []byte(strings.Join(failed, "\n")), nil); err != nil {
+		fmt.Println("cleanup queue error", err, string(key))
+	}
+	return false
+}
+
+// retries the deletes that failed, every interval
+func (a *App) Cleaner(interval time.Duration) {
+	for range time.Tick(interval) {
+		a.reap(cleanupPrefix, time.Now().Unix(), a.cleanup)
+	}
+}
+
+func (a *App) cleanup(key []byte, t int64) bool {
+	ckey := time2key(cleanupPrefix, t, key)
+	data, err := a.db.Get(ckey, nil)
+	if err != nil {
+		return true
+	}
+
+	// the key might have been written again since, to the same files
+	live := make(map[string]bool)
+	if rec := a.GetRecord(key); rec.deleted != HARD {
+		for _, remote := range rec2remotes(key, rec) {
+			live[remote] = true
+		}
+	}
+
+	var failed []string
+	for _, remote := range strings.Split(string(data), "\n") {
+		if live[remote] {
+			continue
+		}
+		if err := remote_delete(remote); err != nil {
+			failed = append(failed, remote)
+		}
+	}
+	if len(failed) == 0 {
+		return true
+	}
+	a.db.Put(ckey, []byte(strings.Join(failed, "\n")), nil)
+	return false
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// *** Compression ***
+
+// the value compressed with the codec, as it's read
+// closing it stops the compression
+func compress_reader(value io.Reader, codec string) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		zw, err := zstd.NewWriter(pw)
+		if err == nil {
+			if _, err = io.Copy(zw, value); err != nil {
+				zw.Close()
+			} else {
+				err = zw.Close()
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// the value uncompressed, which has to be closed
+func decompress_reader(value io.Reader, codec string) (io.ReadCloser, error) {
+	zr, err := zstd.NewReader(value)
+	if err != nil {
+		return nil, err
+	}
+	return zr.IOReadCloser(), nil
+}
+
+// compressed and encrypted values are sent by the master, since the volume servers don't know they are
+// they are decrypted here, and a client that takes the codec gets them compressed, Range isn't supported
+func (a *App) ServeEncoded(w http.ResponseWriter, r *http.Request, rec Record, remote string) {
+	body, err := remote_open(remote)
+	if err != nil {
+		fmt.Println("encoded read error", err, remote)
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(502)
+		return
+	}
+	defer body.Close()
+
+	var value io.Reader = body
+	if rec.keyid != "" {
+		dk, err := a.DataKey(rec)
+		if err == nil {
+			// the record has the data key, the header is for rebuild
+			br := bufio.NewReader(body)
+			if _, _, err = read_encrypt_header(br); err == nil {
+				dr := decrypt_reader(br, dk)
+				defer dr.Close()
+				value = dr
+			}
+		}
+		if err != nil {
+			fmt.Println("decrypt error", err, remote)
+			w.Header().Set("Content-Length", "0")
+			w.WriteHeader(500)
+			return
+		}
+	}
+
+	if rec.codec != "" {
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+	if rec.codec != "" && accepts_encoding(r.Header.Get("Accept-Encoding"), rec.codec) {
+		w.Header().Set("Content-Encoding", rec.codec)
+	} else {
+		if rec.codec != "" {
+			dr, err := decompress_reader(value, rec.codec)
+			if err != nil {
+				fmt.Println("decompress error", err, remote)
+				w.Header().Set("Content-Length", "0")
+				w.WriteHeader(500)
+				return
+			}
+			defer dr.Close()
+			value = dr
+		}
+		if rec.size != 0 {
+			w.Header().Set("Content-Length", strconv.FormatInt(rec.size, 10))
+		}
+	}
+	w.WriteHeader(200)
+	if r.Method == "HEAD" {
+		return
+	}
+	if _, err := io.Copy(w, value); err != nil {
+		// the status is sent already, the client sees it cut short
+		fmt.Println("encoded send error", err, remote)
+	}
+}
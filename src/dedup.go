@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// *** Shared Blobs ***
+
+// many keys can be writing the same blob, so this waits for the lock
+func (a *App) lockBlob(bkey []byte) {
+	for !a.LockKey(bkey) {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// adds a reference to the shared blob with the value, writing it if it's the first
+func (a *App) Ref(rec Record, value io.ReaderAt, size int64) bool {
+	bkey := rec2ref(rec)
+	a.lockBlob(bkey)
+	defer a.UnlockKey(bkey)
+
+	brec := a.GetRecord(bkey)
+	if brec.deleted != NO {
+		kvolumes := a.KeyVolumes(bkey, Record{})
+		var remotes []string
+		for _, volume := range kvolumes {
+			remotes = append(remotes, fmt.Sprintf("http://%s%s", volume, layout2path(bkey, a.layout)))
+		}
+		var written []string
+		failed := false
+		for i, err := range remote_put_all(remotes, size, io.NewSectionReader(value, 0, size), len(remotes)) {
+			if err != nil {
+				fmt.Println("blob write error", err, remotes[i])
+				failed = true
+			} else {
+				written = append(written, remotes[i])
+			}
+		}
+		if a.verify && !failed {
+			for i, err := range remote_verify_all(remotes, size, rec.hashalg, rec.hash) {
+				if err != nil {
+					fmt.Println("blob verify error", err, remotes[i])
+					failed = true
+				}
+			}
+		}
+		if failed {
+			// nothing has the blob yet
+			a.DeleteFiles(bkey, written)
+			return false
+		}
+		brec = Record{rvolumes: kvolumes, deleted: NO, hash: rec.hash, hashalg: rec.hashalg,
+			size: size, mtime: time.Now().Unix(), layout: a.layout}
+	}
+	brec.refs++
+	return a.PutRecord(bkey, brec)
+}
+
+// removes a reference to a shared blob, and the blob with the last one
+func (a *App) Unref(rec Record) bool {
+	bkey := rec2ref(rec)
+	a.lockBlob(bkey)
+	defer a.UnlockKey(bkey)
+
+	brec := a.GetRecord(bkey)
+	if brec.deleted == HARD {
+		return true
+	}
+	brec.refs--
+	if brec.refs > 0 {
+		return a.PutRecord(bkey, brec)
+	}
+
+	// the record stays until the blob is gone, so this can be retried
+	brec.refs = 0
+	if !a.PutRecord(bkey, brec) || !a.DeleteValue(bkey, Record{rvolumes: brec.rvolumes, layout: brec.layout}) {
+		return false
+	}
+	return a.db.Delete(bkey, nil) == nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// *** Drain ***
+
+// moves the keys off the draining volumes while the server runs
+// key2volume doesn't pick them anymore, so this is a rebalance of just their keys
+func (a *App) Drainer() {
+	var draining []string
+	for _, v := range a.volumes {
+		if v.state == DRAINING {
+			draining = append(draining, v.name)
+		}
+	}
+	if len(draining) == 0 {
+		return
+	}
+	for {
+		left, stuck := a.drain(draining)
+		done := true
+		for _, v := range draining {
+			fmt.Printf("draining %s, %d keys left, %d with no copy to move\n", v, left[v], stuck[v])
+			if left[v] != 0 {
+				done = false
+			}
+		}
+		if done {
+			// the keys with no copy are lost already, they don't keep the volumes
+			fmt.Println("drained", draining)
+			return
+		}
+		time.Sleep(1 * time.Minute)
+	}
+}
+
+// one pass over the database, returns how many keys are still on each volume
+// and how many of them can't be moved, since there's no copy of them to read
+func (a *App) drain(draining []string) (map[string]int, map[string]int) {
+	left := make(map[string]int)
+	stuck := make(map[string]int)
+	moved := 0
+	iter := a.db.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		key := append([]byte{}, iter.Key()...)
+		req, ok := a.rebalanceRequest(key, toRecord(iter.Value()))
+		if !ok {
+			continue
+		}
+		on := drained_from(req.volumes, draining)
+		if len(on) == 0 {
+			continue
+		}
+
+		// writes to the key are locked out while it moves
+		// the versions by their key, and the shared blobs by their record
+		lkey := key
+		if vkey, _, ok := key2version(key); ok {
+			lkey = vkey
+		}
+		if a.LockKey(lkey) {
+			// the record might have changed since the iterator saw it
+			rec := a.GetRecord(key)
+			if req, ok = a.rebalanceRequest(key, rec); ok && rebalance(a, req) {
+				on = nil
+				if moved++; moved%1000 == 0 {
+					fmt.Println("draining, moved", moved, "keys")
+				}
+			} else if ok && !a.readable(key, rec) {
+				// like a write that never finished, or one whose copies are all lost
+				fmt.Println("drain impossible, no copy of", string(key))
+				for _, v := range on {
+					stuck[v]++
+				}
+				on = nil
+			}
+			a.UnlockKey(lkey)
+		}
+		for _, v := range on {
+			left[v]++
+		}
+	}
+	return left, stuck
+}
+
+// false if the volumes have no copy of the value to read, or not enough shards
+// a volume that doesn't answer might have one
+func (a *App) readable(key []byte, rec Record) bool {
+	need := 1
+	if rec.data != 0 {
+		need = rec.data
+	}
+	found := 0
+	for _, remote := range rec2remotes(key, rec) {
+		ok, err := remote_head(remote, a.voltimeout)
+		if err != nil {
+			return true
+		}
+		if ok {
+			found++
+		}
+	}
+	return found >= need
+}
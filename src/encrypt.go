@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// *** Encryption ***
+
+// the data key of an encrypted value, unwrapped with the master key it was wrapped with
+func (a *App) DataKey(rec Record) ([]byte, error) {
+	master, ok := a.keys[rec.keyid]
+	if !ok {
+		return nil, fmt.Errorf("master key %s isn't in the key file", rec.keyid)
+	}
+	return unwrap_key(master, rec.wrapped)
+}
+
+// wraps the data keys again with the newest master key, the values on the volumes stay as they are
+// the headers of the files keep the old wrapping, so rebuild needs the old master keys
+func (a *App) Rewrap() {
+	fmt.Println("rewrapping data keys with master key", a.keyid)
+
+	batch := new(leveldb.Batch)
+	flush := func() {
+		if err := a.db.Write(batch, nil); err != nil {
+			panic(fmt.Sprintf("rewrap write failed: %s", err))
+		}
+		batch.Reset()
+	}
+
+	rewrapped, failed := 0, 0
+	iter := a.db.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		if internal_key(iter.Key()) && !bytes.HasPrefix(iter.Key(), versionPrefix) {
+			continue
+		}
+		rec := toRecord(iter.Value())
+		if rec.keyid == "" || rec.keyid == a.keyid {
+			continue
+		}
+		dk, err := a.DataKey(rec)
+		if err == nil {
+			rec.wrapped, err = wrap_key(a.keys[a.keyid], dk)
+		}
+		if err != nil {
+			fmt.Println("rewrap error", err, string(iter.Key()))
+			failed++
+			continue
+		}
+		rec.keyid = a.keyid
+		batch.Put(iter.Key(), fromRecord(rec))
+		rewrapped++
+		if batch.Len() >= 10000 {
+			flush()
+		}
+	}
+	if err := iter.Error(); err != nil {
+		panic(fmt.Sprintf("rewrap iterate failed: %s", err))
+	}
+	flush()
+
+	fmt.Printf("rewrapped %d data keys, %d failed\n", rewrapped, failed)
+}
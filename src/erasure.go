@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// *** Erasure Coding ***
+
+// the data shards are pieces of the value, the last ones padded with zeros
+func data_shards(value io.ReaderAt, size int64, data int) []io.Reader {
+	per := (size + int64(data) - 1) / int64(data)
+	var ret []io.Reader
+	for i := int64(0); i < int64(data); i++ {
+		n := size - i*per
+		if n > per {
+			n = per
+		} else if n < 0 {
+			n = 0
+		}
+		ret = append(ret, io.MultiReader(io.NewSectionReader(value, i*per, n), bytes.NewReader(make([]byte, per-n))))
+	}
+	return ret
+}
+
+// writes shard i of the value to rec.rvolumes[i], all at the same time
+// the parity shards are computed as they are written, so the value is never in memory
+// returns the urls of the shards that were written, on failure too
+// with the ones that failed, except on a full volume, since they can have left part of a shard
+func (a *App) WriteShards(blob []byte, rec Record, value io.ReaderAt) ([]string, error) {
+	if rec.size == 0 {
+		return nil, errors.New("can't split an empty value")
+	}
+	enc, err := reedsolomon.NewStream(rec.data, rec.parity)
+	if err != nil {
+		return nil, err
+	}
+	per := (rec.size + int64(rec.data) - 1) / int64(rec.data)
+
+	shards := data_shards(value, rec.size, rec.data)
+	var pws []io.Writer
+	for i := 0; i < rec.parity; i++ {
+		pr, pw := io.Pipe()
+		shards = append(shards, pr)
+		pws = append(pws, pw)
+	}
+	go func() {
+		err := enc.Encode(data_shards(value, rec.size, rec.data), pws)
+		for _, pw := range pws {
+			pw.(*io.PipeWriter).CloseWithError(err)
+		}
+	}()
+
+	errs := make([]error, len(rec.rvolumes))
+	remotes := make([]string, len(rec.rvolumes))
+	var wg sync.WaitGroup
+	for i, volume := range rec.rvolumes {
+		remotes[i] = fmt.Sprintf("http://%s%s", volume, layout2path(blob2shard(blob, rec, i), rec.layout))
+		wg.Add(1)
+		go func(i int, remote string) {
+			defer wg.Done()
+			errs[i] = remote_put(remote, per, shards[i])
+			if pr, ok := shards[i].(*io.PipeReader); ok {
+				// the encoder doesn't wait for a shard that failed
+				pr.CloseWithError(io.ErrClosedPipe)
+			}
+			if errs[i] != nil {
+				fmt.Printf("shard %d write failed: %s\n", i, remote)
+			}
+		}(i, remotes[i])
+	}
+	wg.Wait()
+
+	var ret error
+	var written []string
+	for i, err := range errs {
+		if err == errFull {
+			a.SetReadOnly(strings.Split(rec.rvolumes[i], "/")[0])
+			ret = err
+		} else {
+			if err != nil && ret == nil {
+				ret = err
+			}
+			written = append(written, remotes[i])
+		}
+	}
+	return written, ret
+}
+
+// opens the shards of the value at the same time, the data shards first
+// and the parity ones if some of those are missing, nil for the ones that aren't open
+func (a *App) OpenShards(blob []byte, rec Record) ([]io.ReadCloser, error) {
+	shards := make([]io.ReadCloser, rec.data+rec.parity)
+	have := 0
+	for _, group := range [][2]int{{0, rec.data}, {rec.data, rec.data + rec.parity}} {
+		if have == rec.data {
+			break
+		}
+		var wg sync.WaitGroup
+		for i := group[0]; i < group[1] && i < len(rec.rvolumes); i++ {
+			if rec.rvolumes[i] == "" {
+				// lost, rebalance puts it back
+				continue
+			}
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				remote := fmt.Sprintf("http://%s%s", rec.rvolumes[i], layout2path(blob2shard(blob, rec, i), rec.layout))
+				body, err := remote_open(remote)
+				if err != nil {
+					fmt.Println("shard read error", err, remote)
+					return
+				}
+				shards[i] = body
+			}(i)
+		}
+		wg.Wait()
+		have = 0
+		for _, shard := range shards {
+			if shard != nil {
+				have++
+			}
+		}
+	}
+	if have < rec.data {
+		close_shards(shards)
+		return nil, errors.New("not enough shards")
+	}
+	return shards, nil
+}
+
+func close_shards(shards []io.ReadCloser) {
+	for _, shard := range shards {
+		if shard != nil {
+			shard.Close()
+		}
+	}
+}
+
+// writes the value from the open shards, streamed from the data shards if they are all there
+// missing data shards are reconstructed from the parity ones into files in -spooldir first
+func (a *App) JoinShards(rec Record, shards []io.ReadCloser, w io.Writer) error {
+	enc, err := reedsolomon.NewStream(rec.data, rec.parity)
+	if err != nil {
+		return err
+	}
+	readers := make([]io.Reader, rec.data)
+	keep := make([]bool, len(shards))
+	missing := false
+	for i := 0; i < rec.data; i++ {
+		keep[i] = true
+		if shards[i] == nil {
+			missing = true
+		} else {
+			readers[i] = shards[i]
+		}
+	}
+	if missing {
+		files, err := a.SpoolShards(rec, shards, keep)
+		if err != nil {
+			return err
+		}
+		defer close_files(files)
+		per := (rec.size + int64(rec.data) - 1) / int64(rec.data)
+		for i := 0; i < rec.data; i++ {
+			readers[i] = io.NewSectionReader(files[i], 0, per)
+		}
+	}
+	return enc.Join(w, readers, rec.size)
+}
+
+// the shards to keep in files in -spooldir, the ones that aren't open are made from the others
+// the ones that are open are copied as the others are made
+func (a *App) SpoolShards(rec Record, shards []io.ReadCloser, keep []bool) ([]*os.File, error) {
+	enc, err := reedsolomon.NewStream(rec.data, rec.parity)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]*os.File, len(shards))
+	valid := make([]io.Reader, len(shards))
+	fill := make([]io.Writer, len(shards))
+	for i := range shards {
+		if keep[i] {
+			if files[i], err = a.SpoolFile(); err != nil {
+				close_files(files)
+				return nil, err
+			}
+		}
+		if shards[i] != nil && keep[i] {
+			valid[i] = io.TeeReader(shards[i], files[i])
+		} else if shards[i] != nil {
+			valid[i] = shards[i]
+		} else if keep[i] {
+			fill[i] = files[i]
+		}
+	}
+	if err := enc.Reconstruct(valid, fill); err != nil {
+		close_files(files)
+		return nil, err
+	}
+	return files, nil
+}
+
+func close_files(files []*os.File) {
+	for _, f := range files {
+		if f != nil {
+			f.Close()
+		}
+	}
+}
+
+func (a *App) DeleteShards(blob []byte, rec Record) bool {
+	delete_error := false
+	for i, volume := range rec.rvolumes {
+		if volume == "" {
+			continue
+		}
+		remote := fmt.Sprintf("http://%s%s", volume, layout2path(blob2shard(blob, rec, i), rec.layout))
+		if remote_delete(remote) != nil {
+			delete_error = true
+		}
+	}
+	return !delete_error
+}
+
+// like rebalance, one shard at a time
+// a shard that is missing is made again from the others
+func rebalance_shards(a *App, req RebalanceRequest, rec Record) bool {
+	if len(req.kvolumes) != rec.data+rec.parity {
+		fmt.Printf("rebalance impossible, %s has %d shards but %d volumes\n", string(req.key), rec.data+rec.parity, len(req.kvolumes))
+		return false
+	}
+
+	// find the shards that are real
+	rvolumes := make([]string, len(req.kvolumes))
+	for i, rv := range rec.rvolumes {
+		if rv == "" || i >= len(rvolumes) {
+			continue
+		}
+		remote_test := fmt.Sprintf("http://%s%s", rv, layout2path(blob2shard(req.blob, rec, i), rec.layout))
+		found, err := remote_head(remote_test, 1*time.Minute)
+		if err != nil {
+			fmt.Println("rebalance head error", err, remote_test)
+			return false
+		}
+		if found {
+			rvolumes[i] = rv
+		}
+	}
+
+	if !needs_rebalance(rvolumes, req.kvolumes) {
+		return true
+	}
+
+	// debug
+	fmt.Println("rebalancing shards", string(req.key), "from", rvolumes, "to", req.kvolumes)
+
+	// streamed from where they are, without holding them in memory
+	per := (rec.size + int64(rec.data) - 1) / int64(rec.data)
+	var files []*os.File
+	for i, v := range req.kvolumes {
+		if rvolumes[i] == v {
+			continue
+		}
+		remote_to := fmt.Sprintf("http://%s%s", v, layout2path(blob2shard(req.blob, rec, i), rec.layout))
+		if rvolumes[i] != "" {
+			remote_from := fmt.Sprintf("http://%s%s", rvolumes[i], layout2path(blob2shard(req.blob, rec, i), rec.layout))
+			body, err := remote_open(remote_from)
+			if err == nil {
+				err = remote_put(remote_to, per, body)
+				body.Close()
+			}
+			if err == nil {
+				continue
+			}
+			fmt.Println("rebalance shard copy error", err, remote_from)
+		}
+		if files == nil {
+			// put the ones that move back together from the others, into files
+			rec.rvolumes = rvolumes
+			shards, err := a.OpenShards(req.blob, rec)
+			if err != nil {
+				fmt.Println("rebalance shard reconstruct error", err, string(req.key))
+				return false
+			}
+			keep := make([]bool, len(shards))
+			for j := range keep {
+				keep[j] = rvolumes[j] != req.kvolumes[j]
+			}
+			files, err = a.SpoolShards(rec, shards, keep)
+			close_shards(shards)
+			if err != nil {
+				fmt.Println("rebalance shard reconstruct error", err, string(req.key))
+				return false
+			}
+			defer close_files(files)
+		}
+		if err := remote_put(remote_to, per, io.NewSectionReader(files[i], 0, per)); err != nil {
+			fmt.Println("rebalance put error", err, remote_to)
+			return false
+		}
+	}
+
+	// update db, keeping everything but the volumes
+	nrec := a.GetRecord(req.key)
+	if nrec.deleted == HARD {
+		fmt.Println("rebalance record vanished", string(req.key))
+		return false
+	}
+	nrec.rvolumes = req.kvolumes
+	if !a.PutRecord(req.key, nrec) {
+		fmt.Println("rebalance put db error", string(req.key))
+		return false
+	}
+
+	// delete the shards from where they were
+	delete_error := false
+	for i, v := range rvolumes {
+		if v != "" && v != req.kvolumes[i] {
+			remote_del := fmt.Sprintf("http://%s%s", v, layout2path(blob2shard(req.blob, rec, i), rec.layout))
+			if err := remote_delete(remote_del); err != nil {
+				fmt.Println("rebalance delete error", err, remote_del)
+				delete_error = true
+			}
+		}
+	}
+	return !delete_error
+}
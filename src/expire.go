@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// *** Reaper ***
+
+// deletes the expired keys, and the unlinked keys past the retention
+func (a *App) Reaper(interval time.Duration) {
+	for range time.Tick(interval) {
+		now := time.Now().Unix()
+		a.reap(expiryPrefix, now, a.expire)
+		if a.retention > 0 {
+			a.reap(unlinkedPrefix, now-int64(a.retention.Seconds()), a.purge)
+		}
+	}
+}
+
+// calls f on every key in the time index up to and including before
+// f returns true when the index entry is no longer needed
+func (a *App) reap(prefix []byte, before int64, f func(key []byte, t int64) bool) {
+	slice := &util.Range{Start: prefix, Limit: time2key(prefix, before+1, nil)}
+	iter := a.db.NewIterator(slice, nil)
+	defer iter.Release()
+	for iter.Next() {
+		t, key := key2time(prefix, iter.Key())
+		key = append([]byte{}, key...)
+
+		// versions are locked by their key
+		lkey := key
+		if vkey, _, ok := key2version(key); ok {
+			lkey = vkey
+		}
+		if !a.LockKey(lkey) {
+			// being written, try again next time
+			continue
+		}
+		done := f(key, t)
+		a.UnlockKey(lkey)
+
+		if done {
+			a.db.Delete(iter.Key(), nil)
+		}
+	}
+}
+
+func (a *App) expire(key []byte, expires int64) bool {
+	rec := a.GetRecord(key)
+	if rec.deleted != HARD && (a.versioned || is_versioned(rec)) {
+		return a.expireVersions(key, rec, expires)
+	}
+	if rec.deleted == HARD || rec.expires != expires {
+		// deleted or written again since
+		return true
+	}
+
+	// the same path as UNLINK then DELETE, so -protect doesn't stop it
+	if rec.deleted == NO {
+		if status := a.Delete(key, true, "expiry"); status != 204 {
+			fmt.Println("expire unlink failed", status, string(key))
+			return false
+		}
+		if a.retention > 0 {
+			// the tombstone is purged after the retention, like any other
+			return true
+		}
+	}
+	if status := a.Delete(key, false, "expiry"); status != 204 {
+		fmt.Println("expire delete failed", status, string(key))
+		return false
+	}
+	return true
+}
+
+// the versions of the key that expired are deleted for good
+// the latest one is hidden behind a delete marker first, like a DELETE would
+func (a *App) expireVersions(key []byte, rec Record, expires int64) bool {
+	if !is_versioned(rec) {
+		if unversioned, ok := unversioned2version(rec); !ok || unversioned.expires != expires {
+			// written again since
+			return true
+		}
+		// written before -versioned, the delete marker makes it a version
+		if status := a.DeleteMarker(key, rec); status != 204 {
+			fmt.Println("expire delete marker failed", status, string(key))
+			return false
+		}
+	}
+	for _, v := range a.GetVersions(key) {
+		if v.expires != expires {
+			continue
+		}
+		if latest := a.GetRecord(key); latest.deleted == NO && latest.version == v.version {
+			if status := a.DeleteMarker(key, latest); status != 204 {
+				fmt.Println("expire delete marker failed", status, string(key))
+				return false
+			}
+		}
+		if status := a.DeleteVersion(key, v.version); status != 204 {
+			fmt.Println("expire delete version failed", status, string(key))
+			return false
+		}
+	}
+	return true
+}
+
+func (a *App) purge(key []byte, unlinked int64) bool {
+	rec := a.GetRecord(key)
+	if rec.deleted != SOFT || rec.unlinked != unlinked {
+		// deleted or written again since
+		return true
+	}
+	if status := a.Delete(key, false, "retention"); status != 204 {
+		fmt.Println("purge delete failed", status, string(key))
+		return false
+	}
+	return true
+}
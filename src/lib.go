@@ -1,18 +1,33 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"lukechampine.com/blake3"
 )
 
 // *** DB Type ***
@@ -28,9 +43,149 @@ type Record struct {
 	rvolumes []string
 	deleted  Deleted
 	hash     string
+	hashalg  string
+
+	// stats of the value, zero in records from before they were stored
+	size  int64
+	mtime int64 // unix seconds
+	ctype string
+
+	// user defined metadata, from the X-Mkv-Meta-* headers
+	meta map[string]string
+
+	// unix seconds, zero if it never expires
+	expires int64
+
+	// when and by whom the key was unlinked, zero for records from before this was stored
+	unlinked   int64
+	unlinkedby string
+
+	// the value is in a blob shared by every key with the same hash
+	// the volumes of the key only have an empty file linking to it
+	dedup bool
+	// on a shared blob, how many keys link to it
+	refs int64
+
+	// empty for a value that was written once, otherwise it's part of the path on the volumes
+	// the record of a versioned key has no volumes, it points at the latest version
+	version string
+
+	// an erasure coded value is split into data and parity shards, shard i is on rvolumes[i]
+	// zero for a value that is replicated
+	data   int
+	parity int
+
+	// how the path of the value on the volumes is made, see layout2path
+	layout int
+
+	// replicas that weren't written with a quorum write, not in rvolumes
+	// the repairer writes them once the volumes are back
+	missing []string
+
+	// the value is compressed on the volumes, size is what it is uncompressed
+	// empty for a value that is stored as it is
+	codec string
+
+	// the value is encrypted with a data key, which is wrapped with the master key keyid
+	// empty for a value that isn't encrypted
+	keyid   string
+	wrapped []byte
+}
+
+// records on disk start with a version byte, followed by the encoded record
+// legacy (version 0) records are plain strings, which never start with a control character
+const recordVersion byte = 1
+
+// the encoding of a Record after the version byte
+// new fields must be optional so that older records still decode
+type diskRecord struct {
+	Volumes []string          `json:"volumes"`
+	Deleted bool              `json:"deleted,omitempty"`
+	Hash    string            `json:"hash,omitempty"`
+	HashAlg string            `json:"hashalg,omitempty"`
+	Size    int64             `json:"size,omitempty"`
+	Mtime   int64             `json:"mtime,omitempty"`
+	Ctype   string            `json:"ctype,omitempty"`
+	Meta    map[string]string `json:"meta,omitempty"`
+	Version string            `json:"version,omitempty"`
+	Expires int64             `json:"expires,omitempty"`
+
+	Unlinked   int64  `json:"unlinked,omitempty"`
+	UnlinkedBy string `json:"unlinkedby,omitempty"`
+
+	Dedup bool  `json:"dedup,omitempty"`
+	Refs  int64 `json:"refs,omitempty"`
+
+	Data   int `json:"data,omitempty"`
+	Parity int `json:"parity,omitempty"`
+
+	Layout int `json:"layout,omitempty"`
+
+	Missing []string `json:"missing,omitempty"`
+
+	Codec string `json:"codec,omitempty"`
+
+	KeyID   string `json:"keyid,omitempty"`
+	Wrapped []byte `json:"wrapped,omitempty"`
+}
+
+func record_version(data []byte) byte {
+	if len(data) > 0 && data[0] < ' ' {
+		return data[0]
+	}
+	return 0
 }
 
 func toRecord(data []byte) Record {
+	switch v := record_version(data); v {
+	case 0:
+		return toLegacyRecord(data)
+	case recordVersion:
+		var dr diskRecord
+		if err := json.Unmarshal(data[1:], &dr); err != nil {
+			panic(fmt.Sprintf("Can't decode record: %s", err))
+		}
+		rec := Record{rvolumes: dr.Volumes, hash: dr.Hash, hashalg: dr.HashAlg,
+			size: dr.Size, mtime: dr.Mtime, ctype: dr.Ctype, meta: dr.Meta,
+			version: dr.Version, expires: dr.Expires,
+			unlinked: dr.Unlinked, unlinkedby: dr.UnlinkedBy,
+			dedup: dr.Dedup, refs: dr.Refs,
+			data: dr.Data, parity: dr.Parity, layout: dr.Layout,
+			missing: dr.Missing, codec: dr.Codec,
+			keyid: dr.KeyID, wrapped: dr.Wrapped}
+		if rec.rvolumes == nil {
+			rec.rvolumes = []string{}
+		}
+		if dr.Deleted {
+			rec.deleted = SOFT
+		}
+		return rec
+	default:
+		panic(fmt.Sprintf("Record version %d is newer than this binary", v))
+	}
+}
+
+func fromRecord(rec Record) []byte {
+	if rec.deleted == HARD {
+		panic("Can't put HARD delete in the database")
+	}
+	dr := diskRecord{Volumes: rec.rvolumes, Deleted: rec.deleted == SOFT, Hash: rec.hash, HashAlg: rec.hashalg,
+		Size: rec.size, Mtime: rec.mtime, Ctype: rec.ctype, Meta: rec.meta,
+		Version: rec.version, Expires: rec.expires,
+		Unlinked: rec.unlinked, UnlinkedBy: rec.unlinkedby,
+		Dedup: rec.dedup, Refs: rec.refs,
+		Data: rec.data, Parity: rec.parity, Layout: rec.layout,
+		Missing: rec.missing, Codec: rec.codec,
+		KeyID: rec.keyid, Wrapped: rec.wrapped}
+	data, err := json.Marshal(dr)
+	if err != nil {
+		panic(fmt.Sprintf("Can't encode record: %s", err))
+	}
+	return append([]byte{recordVersion}, data...)
+}
+
+// the original string format, only decoded now (migrate-index rewrites it)
+func toLegacyRecord(data []byte) Record {
 	var rec Record
 	ss := string(data)
 	rec.deleted = NO
@@ -40,24 +195,839 @@ func toRecord(data []byte) Record {
 	}
 	if strings.HasPrefix(ss, "HASH") {
 		rec.hash = ss[4:36]
+		rec.hashalg = "md5"
 		ss = ss[36:]
 	}
 	rec.rvolumes = strings.Split(ss, ",")
 	return rec
 }
 
-func fromRecord(rec Record) []byte {
-	cc := ""
-	if rec.deleted == HARD {
-		panic("Can't put HARD delete in the database")
+// *** Keyspaces ***
+
+// user keys always start with "/", the internal keyspaces start with a zero byte
+func internal_key(key []byte) bool {
+	return len(key) > 0 && key[0] == 0
+}
+
+// *** Versions ***
+
+var versionPrefix = []byte("\x00versions")
+
+func is_versioned(rec Record) bool {
+	return rec.version != "" && len(rec.rvolumes) == 0
+}
+
+// versions sort in the order they were created
+func new_version() string {
+	return fmt.Sprintf("%016x", time.Now().UnixNano())
+}
+
+// the version of a value written before the key was versioned
+// it sorts before the others, and isn't in the name on the volumes
+const nullVersion = "0000000000000000"
+
+// the version a value written before the key was versioned is kept as, where it is
+// false if there is nothing to keep, a write that never finished included
+func unversioned2version(rec Record) (Record, bool) {
+	if rec.deleted == HARD || is_versioned(rec) || (rec.deleted == SOFT && rec.unlinked == 0) {
+		return Record{}, false
+	}
+	if rec.version == "" {
+		rec.version = nullVersion
+	}
+	// an unlinked one stays deleted
+	return rec, true
+}
+
+// the key the value is stored under on the volume servers
+func rec2blob(key []byte, rec Record) []byte {
+	ret := append([]byte{}, key...)
+	if rec.version != "" && rec.version != nullVersion {
+		ret = append(ret, 0)
+		ret = append(ret, rec.version...)
+	}
+	if rec.dedup {
+		// the name of the link says where the value is
+		ret = append(ret, 1)
+		ret = append(ret, rec.hashalg+":"+rec.hash...)
+	}
+	if rec.codec != "" {
+		ret = append(ret, 3)
+		ret = append(ret, rec.codec...)
+	}
+	if rec.keyid != "" {
+		ret = append(ret, 4)
+		ret = append(ret, cipherName...)
+	}
+	return ret
+}
+
+// splits the shared blob off the name of a link
+func blob2link(blob []byte) ([]byte, string) {
+	i := bytes.LastIndexByte(blob, 1)
+	if i == -1 {
+		return blob, ""
+	}
+	return blob[:i], string(blob[i+1:])
+}
+
+func blob2key(blob []byte) ([]byte, string) {
+	i := bytes.LastIndexByte(blob, 0)
+	if i == -1 {
+		return blob, ""
+	}
+	return blob[:i], string(blob[i+1:])
+}
+
+// the key of a version in the database
+// with an empty version, this is the prefix of all the versions of the key
+func version2key(key []byte, version string) []byte {
+	ret := append([]byte{}, versionPrefix...)
+	ret = append(ret, key...)
+	ret = append(ret, 0)
+	return append(ret, version...)
+}
+
+func key2version(vkey []byte) ([]byte, string, bool) {
+	if !bytes.HasPrefix(vkey, versionPrefix) {
+		return nil, "", false
+	}
+	key, version := blob2key(vkey[len(versionPrefix):])
+	return key, version, version != ""
+}
+
+// *** Shared Blobs ***
+
+// the records of the shared blobs, by hash
+var blobPrefix = []byte("\x00blobs")
+
+// the key of the shared blob with the value of a record
+// it's also the key the blob is stored under on the volume servers
+func rec2ref(rec Record) []byte {
+	return ref2key(rec.hashalg + ":" + rec.hash)
+}
+
+func ref2key(ref string) []byte {
+	return append(append([]byte{}, blobPrefix...), ref...)
+}
+
+// *** Time Indexes ***
+
+// keys to expire, keys that were unlinked, keys with replicas to repair
+// and keys with files to clean up, all ordered by time, then key
+var expiryPrefix = []byte("\x00expires")
+var unlinkedPrefix = []byte("\x00unlinked")
+var repairPrefix = []byte("\x00repair")
+
+// files that failed writes left behind, and couldn't be deleted right away
+// the value of the entry is their urls, one per line
+var cleanupPrefix = []byte("\x00cleanup")
+
+func time2key(prefix []byte, t int64, key []byte) []byte {
+	var be [8]byte
+	binary.BigEndian.PutUint64(be[:], uint64(t))
+	ret := append([]byte{}, prefix...)
+	ret = append(ret, be[:]...)
+	return append(ret, key...)
+}
+
+func key2time(prefix []byte, tkey []byte) (int64, []byte) {
+	tkey = tkey[len(prefix):]
+	return int64(binary.BigEndian.Uint64(tkey[:8])), tkey[8:]
+}
+
+// *** Expiry ***
+
+func expired(rec Record) bool {
+	return rec.expires != 0 && rec.expires <= time.Now().Unix()
+}
+
+// the expiry of a value, from X-Mkv-Expires (a http date) or X-Mkv-Ttl (seconds or a duration)
+func header2expires(header http.Header, now time.Time) (int64, error) {
+	if v := header.Get("X-Mkv-Expires"); v != "" {
+		t, err := http.ParseTime(v)
+		if err != nil {
+			return 0, fmt.Errorf("bad X-Mkv-Expires: %s", err)
+		}
+		return t.Unix(), nil
+	}
+	if v := header.Get("X-Mkv-Ttl"); v != "" {
+		ttl, err := time.ParseDuration(v)
+		if err != nil {
+			secs, serr := strconv.ParseInt(v, 10, 64)
+			if serr != nil {
+				return 0, fmt.Errorf("bad X-Mkv-Ttl: %s", err)
+			}
+			ttl = time.Duration(secs) * time.Second
+		}
+		if ttl <= 0 {
+			return 0, fmt.Errorf("bad X-Mkv-Ttl: %s", v)
+		}
+		return now.Add(ttl).Unix(), nil
+	}
+	return 0, nil
+}
+
+// *** Metadata ***
+
+// metadata headers are accepted with either prefix and echoed back with both
+var metaPrefixes = []string{"X-Mkv-Meta-", "X-Amz-Meta-"}
+
+// metadata lives in the index, so keep it small
+const maxMetaSize = 8192
+
+func header2meta(header http.Header) (map[string]string, error) {
+	var meta map[string]string
+	size := 0
+	for k, v := range header {
+		for _, prefix := range metaPrefixes {
+			if len(k) > len(prefix) && strings.EqualFold(k[:len(prefix)], prefix) {
+				if meta == nil {
+					meta = make(map[string]string)
+				}
+				name := strings.ToLower(k[len(prefix):])
+				meta[name] = strings.Join(v, ",")
+				size += len(name) + len(meta[name])
+			}
+		}
+	}
+	if size > maxMetaSize {
+		return nil, fmt.Errorf("metadata is %d bytes, max is %d", size, maxMetaSize)
+	}
+	return meta, nil
+}
+
+// the headers of a multipart initiate request that apply to the finished value
+// the checksums in them are of the initiate request, not the value
+func upload_header(header http.Header) http.Header {
+	ret := http.Header{}
+	for k, v := range header {
+		keep := k == "Content-Type" || k == "X-Mkv-Ttl" || k == "X-Mkv-Expires"
+		for _, prefix := range metaPrefixes {
+			keep = keep || (len(k) > len(prefix) && strings.EqualFold(k[:len(prefix)], prefix))
+		}
+		if keep {
+			ret[k] = v
+		}
+	}
+	return ret
+}
+
+func meta2header(meta map[string]string, header http.Header) {
+	for k, v := range meta {
+		for _, prefix := range metaPrefixes {
+			header.Set(prefix+k, v)
+		}
+	}
+}
+
+// *** Checksums ***
+
+// the etag of a value is its hash, * matches any value
+func etag_match(header string, hash string) bool {
+	for _, etag := range strings.Split(header, ",") {
+		etag = strings.TrimSpace(etag)
+		if etag == "*" {
+			return true
+		}
+		etag = strings.Trim(strings.TrimPrefix(etag, "W/"), `"`)
+		if hash != "" && etag == hash {
+			return true
+		}
+	}
+	return false
+}
+
+var checksums = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha256": sha256.New,
+	"crc32c": func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) },
+	"blake3": func() hash.Hash { return blake3.New(32, nil) },
+}
+
+// the names of the checksums in the Digest header (RFC 3230)
+var digestNames = map[string]string{
+	"md5":    "md5",
+	"sha256": "sha-256",
+	"crc32c": "crc32c",
+	"blake3": "blake3",
+}
+
+// checksums supplied by the client, from the Digest, Content-MD5, x-amz-checksum-* and x-amz-content-sha256 headers
+// two headers with different sums for the same algorithm are an error
+func header2checksums(header http.Header) (map[string][]byte, error) {
+	ret := make(map[string][]byte)
+	set := func(alg string, sum []byte) error {
+		if prev, ok := ret[alg]; ok && !bytes.Equal(prev, sum) {
+			return fmt.Errorf("conflicting %s checksums", alg)
+		}
+		ret[alg] = sum
+		return nil
+	}
+	add := func(alg string, b64 string) error {
+		sum, err := base64.StdEncoding.DecodeString(strings.TrimSpace(b64))
+		if err != nil {
+			return fmt.Errorf("bad %s checksum: %s", alg, err)
+		}
+		return set(alg, sum)
+	}
+	for _, digest := range header.Values("Digest") {
+		for _, d := range strings.Split(digest, ",") {
+			kv := strings.SplitN(strings.TrimSpace(d), "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			// unknown algorithms are ignored
+			for alg, name := range digestNames {
+				if strings.EqualFold(kv[0], name) {
+					if err := add(alg, kv[1]); err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+	}
+	for alg := range checksums {
+		if v := header.Get("X-Amz-Checksum-" + alg); v != "" {
+			if err := add(alg, v); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if v := header.Get("Content-MD5"); v != "" {
+		if err := add("md5", v); err != nil {
+			return nil, err
+		}
+	}
+	// hex, or something like UNSIGNED-PAYLOAD when the client didn't hash it
+	if v := header.Get("X-Amz-Content-Sha256"); len(v) == 64 {
+		if sum, err := hex.DecodeString(v); err == nil {
+			if err := set("sha256", sum); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return ret, nil
+}
+
+func checksum2header(alg string, hexsum string, header http.Header) {
+	sum, err := hex.DecodeString(hexsum)
+	if err != nil || hexsum == "" {
+		return
+	}
+	b64sum := base64.StdEncoding.EncodeToString(sum)
+	header.Set("Digest", digestNames[alg]+"="+b64sum)
+	switch alg {
+	case "md5":
+		// note that this isn't base64 like the RFC says, it's always been hex
+		header.Set("Content-Md5", hexsum)
+	case "sha256", "crc32c":
+		header.Set("X-Amz-Checksum-"+alg, b64sum)
+	}
+}
+
+// *** Volumes ***
+
+type Volume struct {
+	name       string
+	weight     float64 // the share of the keys, relative to the other volumes
+	zone       string  // the failure domain, replicas go to different ones
+	subvolumes int     // disks on this machine, 0 is the -subvolumes default
+	state      string
+}
+
+const (
+	ACTIVE   = "active"
+	DRAINING = "draining" // no new keys, the old ones are moved off
+	READONLY = "readonly" // no new keys, the old ones stay
+)
+
+// the volumes that filled up while running, by name
+var readonlyPrefix = []byte("\x00readonly")
+
+func readonly2key(volume string) []byte {
+	return append(append([]byte{}, readonlyPrefix...), volume...)
+}
+
+func (v Volume) String() string {
+	s := v.name
+	if v.zone != "" {
+		s += "@" + v.zone
+	}
+	if v.weight != 1 {
+		s += fmt.Sprintf("=%g", v.weight)
+	}
+	if v.state != ACTIVE {
+		s += " (" + v.state + ")"
+	}
+	return s
+}
+
+// a volume without a zone is a failure domain of its own
+func (v Volume) domain() string {
+	if v.zone == "" {
+		return "\x00" + v.name
+	}
+	return v.zone
+}
+
+// volumes are host:port, optionally with a zone and a weight like host:port@rack1=2.5
+func parse_volumes(s string) ([]Volume, error) {
+	var volumes []Volume
+	for _, vs := range strings.Split(s, ",") {
+		v := Volume{name: vs, weight: 1}
+		if i := strings.LastIndex(v.name, "="); i != -1 {
+			weight, err := strconv.ParseFloat(v.name[i+1:], 64)
+			if err != nil || weight <= 0 || math.IsInf(weight, 0) {
+				return nil, fmt.Errorf("bad weight for volume %s", vs)
+			}
+			v.name, v.weight = v.name[:i], weight
+		}
+		if i := strings.LastIndex(v.name, "@"); i != -1 {
+			if i == len(v.name)-1 {
+				return nil, fmt.Errorf("bad zone for volume %s", vs)
+			}
+			v.name, v.zone = v.name[:i], v.name[i+1:]
+		}
+		v.state = ACTIVE
+		volumes = append(volumes, v)
+	}
+	return volumes, check_volumes(volumes)
+}
+
+// the topology file, for what doesn't fit in -volumes and -policies
+// {"volumes": [{"host": "host:port", "weight": 2, "zone": "rack1", "subvolumes": 4, "state": "active"}],
+// "policies": [{"prefix": "/scratch/", "replicas": 1, "subvolumes": 2}, {"prefix": "/logs/", "data": 6, "parity": 3},
+// {"prefix": "/json/", "compress": "zstd"}]}
+type topologyFile struct {
+	Volumes []struct {
+		Host       string  `json:"host"`
+		Weight     float64 `json:"weight"`
+		Zone       string  `json:"zone"`
+		Subvolumes int     `json:"subvolumes"`
+		State      string  `json:"state"`
+	} `json:"volumes"`
+	Policies []struct {
+		Prefix     string `json:"prefix"`
+		Replicas   int    `json:"replicas"`
+		Subvolumes int    `json:"subvolumes"`
+		Data       int    `json:"data"`
+		Parity     int    `json:"parity"`
+		Compress   string `json:"compress"`
+	} `json:"policies"`
+}
+
+func parse_topology(data []byte) ([]Volume, []Policy, error) {
+	var t topologyFile
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&t); err != nil {
+		return nil, nil, fmt.Errorf("bad topology: %s", err)
+	}
+	var policies []Policy
+	for _, tp := range t.Policies {
+		policies = append(policies, Policy{prefix: tp.Prefix, replicas: tp.Replicas, subvolumes: tp.Subvolumes,
+			data: tp.Data, parity: tp.Parity, compress: tp.Compress})
+	}
+	if err := check_policies(policies); err != nil {
+		return nil, nil, err
+	}
+	var volumes []Volume
+	for _, tv := range t.Volumes {
+		v := Volume{name: tv.Host, weight: tv.Weight, zone: tv.Zone, subvolumes: tv.Subvolumes, state: tv.State}
+		if v.weight == 0 {
+			v.weight = 1
+		}
+		if v.state == "" {
+			v.state = ACTIVE
+		}
+		volumes = append(volumes, v)
+	}
+	return volumes, policies, check_volumes(volumes)
+}
+
+func check_volumes(volumes []Volume) error {
+	if len(volumes) == 0 {
+		return errors.New("no volumes")
+	}
+	seen := map[string]bool{}
+	for _, v := range volumes {
+		if v.name == "" {
+			return errors.New("volume without a host")
+		}
+		if seen[v.name] {
+			return fmt.Errorf("volume %s is there twice", v.name)
+		}
+		seen[v.name] = true
+		if v.weight <= 0 || math.IsInf(v.weight, 0) || math.IsNaN(v.weight) {
+			return fmt.Errorf("bad weight for volume %s", v.name)
+		}
+		if v.subvolumes < 0 {
+			return fmt.Errorf("bad subvolumes for volume %s", v.name)
+		}
+		if v.state != ACTIVE && v.state != DRAINING && v.state != READONLY {
+			return fmt.Errorf("unknown state %s for volume %s", v.state, v.name)
+		}
+	}
+	return nil
+}
+
+// *** Policies ***
+
+// how many copies of the keys with the prefix to keep, and on how many subvolumes
+// or how many data and parity shards to split them into
+// and how to compress them, one of the codecs or none
+// zero is the -replicas, -subvolumes, -erasure and -compress default
+// a volume with subvolumes of its own in the topology keeps them, those are its disks
+type Policy struct {
+	prefix     string
+	replicas   int
+	subvolumes int
+	data       int
+	parity     int
+	compress   string
+}
+
+// how many volumes a value takes
+func (p Policy) count() int {
+	if p.data != 0 {
+		return p.data + p.parity
+	}
+	return p.replicas
+}
+
+// policies are prefix=replicas, like /scratch/=1
+func parse_policies(s string) ([]Policy, error) {
+	var policies []Policy
+	for _, ps := range strings.Split(s, ",") {
+		i := strings.LastIndex(ps, "=")
+		if i == -1 {
+			return nil, fmt.Errorf("policy %s needs replicas", ps)
+		}
+		replicas, err := strconv.Atoi(ps[i+1:])
+		if err != nil || replicas == 0 {
+			return nil, fmt.Errorf("bad replicas for policy %s", ps)
+		}
+		policies = append(policies, Policy{prefix: ps[:i], replicas: replicas})
 	}
-	if rec.deleted == SOFT {
-		cc = "DELETED"
+	return policies, check_policies(policies)
+}
+
+func check_policies(policies []Policy) error {
+	seen := map[string]bool{}
+	for _, p := range policies {
+		if !strings.HasPrefix(p.prefix, "/") {
+			return fmt.Errorf("policy prefix %s must start with /", p.prefix)
+		}
+		if seen[p.prefix] {
+			return fmt.Errorf("policy %s is there twice", p.prefix)
+		}
+		seen[p.prefix] = true
+		if p.replicas < 0 || p.subvolumes < 0 || check_erasure(p.data, p.parity) != nil {
+			return fmt.Errorf("bad policy %s", p.prefix)
+		}
+		if p.compress != "" && p.compress != "none" && !codecs[p.compress] {
+			return fmt.Errorf("unknown codec %s for policy %s", p.compress, p.prefix)
+		}
+		if p.replicas == 0 && p.subvolumes == 0 && p.data == 0 && p.compress == "" {
+			// it would be the defaults, which is probably not what was meant
+			return fmt.Errorf("policy %s sets nothing", p.prefix)
+		}
 	}
-	if len(rec.hash) == 32 {
-		cc += "HASH" + rec.hash
+	return nil
+}
+
+// the policy with the longest prefix of the key wins
+func key2policy(key []byte, policies []Policy) (Policy, bool) {
+	var ret Policy
+	found := false
+	for _, p := range policies {
+		if bytes.HasPrefix(key, []byte(p.prefix)) && len(p.prefix) >= len(ret.prefix) {
+			ret, found = p, true
+		}
+	}
+	return ret, found
+}
+
+// *** Compression ***
+
+// the codecs values can be compressed with on the volumes
+var codecs = map[string]bool{"zstd": true}
+
+// a compressed value has the codec in the name, so rebuild knows it
+func blob2codec(blob []byte) ([]byte, string) {
+	i := bytes.LastIndexByte(blob, 3)
+	if i == -1 || !codecs[string(blob[i+1:])] {
+		return blob, ""
 	}
-	return []byte(cc + strings.Join(rec.rvolumes, ","))
+	return blob[:i], string(blob[i+1:])
+}
+
+// if the Accept-Encoding header takes the codec, so a compressed value can be sent as it is
+func accepts_encoding(header string, codec string) bool {
+	for _, e := range strings.Split(header, ",") {
+		parts := strings.Split(e, ";")
+		if strings.TrimSpace(parts[0]) != codec {
+			continue
+		}
+		for _, p := range parts[1:] {
+			if q := strings.TrimSpace(p); strings.HasPrefix(q, "q=") {
+				if v, err := strconv.ParseFloat(q[2:], 64); err == nil && v == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// *** Encryption ***
+
+// encrypted values have this in the name, so rebuild knows to read the header
+const cipherName = "aes-gcm"
+
+// the value is encrypted in chunks, so it can be streamed
+const encChunk = 64 * 1024
+
+// the key file has a master key per line, an id and 64 hex digits like "2024-01 00112233...eeff"
+// the last one wraps new data keys, the ones before it unwrap the older ones
+func parse_keyfile(data []byte) (map[string][]byte, string, error) {
+	keys := make(map[string][]byte)
+	current := ""
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 || len(fields[0]) > 255 {
+			return nil, "", fmt.Errorf("bad key file line, should be id and key")
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil || len(key) != 32 {
+			return nil, "", fmt.Errorf("key %s must be 64 hex digits", fields[0])
+		}
+		if _, ok := keys[fields[0]]; ok {
+			return nil, "", fmt.Errorf("key %s is there twice", fields[0])
+		}
+		keys[fields[0]] = key
+		current = fields[0]
+	}
+	if current == "" {
+		return nil, "", errors.New("no keys in the key file")
+	}
+	return keys, current, nil
+}
+
+func new_gcm(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encrypts a data key with a master key, the random nonce goes first
+func wrap_key(master []byte, dk []byte) ([]byte, error) {
+	gcm, err := new_gcm(master)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, dk, nil), nil
+}
+
+func unwrap_key(master []byte, wrapped []byte) ([]byte, error) {
+	gcm, err := new_gcm(master)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < gcm.NonceSize() {
+		return nil, errors.New("wrapped key is too short")
+	}
+	return gcm.Open(nil, wrapped[:gcm.NonceSize()], wrapped[gcm.NonceSize():], nil)
+}
+
+// the file starts with the wrapped data key, for rebuild
+// a version byte, then the id of the master key and the wrapped key, each after its length
+func encrypt_header(keyid string, wrapped []byte) []byte {
+	ret := []byte{1, byte(len(keyid))}
+	ret = append(ret, keyid...)
+	ret = append(ret, byte(len(wrapped)))
+	return append(ret, wrapped...)
+}
+
+func read_encrypt_header(r *bufio.Reader) (string, []byte, error) {
+	if v, err := r.ReadByte(); err != nil || v != 1 {
+		return "", nil, errors.New("bad encryption header")
+	}
+	var fields [][]byte
+	for i := 0; i < 2; i++ {
+		n, err := r.ReadByte()
+		if err != nil {
+			return "", nil, err
+		}
+		field := make([]byte, n)
+		if _, err := io.ReadFull(r, field); err != nil {
+			return "", nil, err
+		}
+		fields = append(fields, field)
+	}
+	return string(fields[0]), fields[1], nil
+}
+
+// chunk i of a value, the last one is marked so the value can't be cut short
+func chunk_nonce(i uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], i)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// the header, then the value encrypted with the data key, as it's read
+// each data key encrypts one value, so the nonces can count the chunks
+// closing it stops the encryption
+func encrypt_reader(value io.Reader, dk []byte, header []byte) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		gcm, err := new_gcm(dk)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if _, err := pw.Write(header); err != nil {
+			return
+		}
+		cur := make([]byte, encChunk)
+		n, rerr := io.ReadFull(value, cur)
+		for i := uint64(0); ; i++ {
+			var next []byte
+			var m int
+			last := rerr == io.EOF || rerr == io.ErrUnexpectedEOF
+			if rerr != nil && !last {
+				pw.CloseWithError(rerr)
+				return
+			}
+			if !last {
+				// the one after says if this one is the last
+				next = make([]byte, encChunk)
+				if m, rerr = io.ReadFull(value, next); rerr == io.EOF {
+					last = true
+				}
+			}
+			if _, err := pw.Write(gcm.Seal(nil, chunk_nonce(i, last), cur[:n], nil)); err != nil {
+				return
+			}
+			if last {
+				pw.Close()
+				return
+			}
+			cur, n = next, m
+		}
+	}()
+	return pr
+}
+
+// the value, from what encrypt_reader made after the header
+// closing it stops the decryption
+func decrypt_reader(body io.Reader, dk []byte) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		gcm, err := new_gcm(dk)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		br := bufio.NewReader(body)
+		chunk := make([]byte, encChunk+gcm.Overhead())
+		for i := uint64(0); ; i++ {
+			n, err := io.ReadFull(br, chunk)
+			if err == io.EOF {
+				pw.CloseWithError(errors.New("encrypted value is cut short"))
+				return
+			} else if err != nil && err != io.ErrUnexpectedEOF {
+				pw.CloseWithError(err)
+				return
+			}
+			last := err == io.ErrUnexpectedEOF
+			if !last {
+				if _, err := br.Peek(1); err == io.EOF {
+					last = true
+				}
+			}
+			plain, err := gcm.Open(nil, chunk_nonce(i, last), chunk[:n], nil)
+			if err != nil {
+				pw.CloseWithError(errors.New("encrypted value doesn't decrypt"))
+				return
+			}
+			if _, err := pw.Write(plain); err != nil {
+				return
+			}
+			if last {
+				pw.Close()
+				return
+			}
+		}
+	}()
+	return pr
+}
+
+// an encrypted value has the cipher in the name, after the codec
+func blob2cipher(blob []byte) ([]byte, bool) {
+	i := bytes.LastIndexByte(blob, 4)
+	if i == -1 || string(blob[i+1:]) != cipherName {
+		return blob, false
+	}
+	return blob[:i], true
+}
+
+// *** Erasure Coding ***
+
+// -erasure is data,parity like 6,3
+func parse_erasure(s string) (int, int, error) {
+	var data, parity int
+	if n, err := fmt.Sscanf(s, "%d,%d", &data, &parity); err != nil || n != 2 || fmt.Sprintf("%d,%d", data, parity) != s {
+		return 0, 0, fmt.Errorf("bad erasure coding %s, should be data,parity", s)
+	}
+	return data, parity, check_erasure(data, parity)
+}
+
+func check_erasure(data int, parity int) error {
+	if data == 0 && parity == 0 {
+		return nil
+	}
+	if data < 1 || parity < 1 || data+parity > 256 {
+		return fmt.Errorf("bad erasure coding %d,%d", data, parity)
+	}
+	return nil
+}
+
+// the name of shard i of the value on the volumes
+// it has what's needed to put the value back together, so rebuild can find it
+func blob2shard(blob []byte, rec Record, i int) []byte {
+	ret := append([]byte{}, blob...)
+	ret = append(ret, 2)
+	return append(ret, fmt.Sprintf("%d,%d,%d,%d", rec.data, rec.parity, i, rec.size)...)
+}
+
+// the blob, the record of the erasure coding and the shard number, which is -1 if it's not a shard
+func shard2blob(shard []byte) ([]byte, Record, int) {
+	idx := bytes.LastIndexByte(shard, 2)
+	if idx == -1 {
+		return shard, Record{}, -1
+	}
+	var rec Record
+	var i int
+	if n, _ := fmt.Sscanf(string(shard[idx+1:]), "%d,%d,%d,%d", &rec.data, &rec.parity, &i, &rec.size); n != 4 ||
+		check_erasure(rec.data, rec.parity) != nil || rec.data == 0 || i < 0 || i >= rec.data+rec.parity {
+		return shard, Record{}, -1
+	}
+	return shard[:idx], rec, i
 }
 
 // *** Hash Functions ***
@@ -71,38 +1041,126 @@ func key2path(key []byte) string {
 	return fmt.Sprintf("/%02x/%02x/%s", mkey[0], mkey[1], b64key)
 }
 
+// layout 0 is key2path, the / of standard base64 makes directories for some keys
+// layout n is n directories deep, with url safe base64
+const maxLayout = 8
+
+func layout2path(key []byte, layout int) string {
+	if layout == 0 {
+		return key2path(key)
+	}
+	mkey := md5.Sum(key)
+	var sb strings.Builder
+	for i := 0; i < layout; i++ {
+		fmt.Fprintf(&sb, "/%02x", mkey[i])
+	}
+	sb.WriteString("/" + base64.RawURLEncoding.EncodeToString(key))
+	return sb.String()
+}
+
+// the key and the layout of a path on a volume, false if it isn't one
+func path2key(path string) ([]byte, int, bool) {
+	parts := strings.Split(path, "/")
+	if layout := len(parts) - 2; layout >= 1 && layout <= maxLayout {
+		key, err := base64.RawURLEncoding.DecodeString(parts[len(parts)-1])
+		if err == nil && layout2path(key, layout) == path {
+			return key, layout, true
+		}
+	}
+	// everything after the two directories, even more of them
+	if len(parts) >= 4 {
+		key, err := base64.StdEncoding.DecodeString(strings.Join(parts[3:], "/"))
+		if err == nil && key2path(key) == path {
+			return key, 0, true
+		}
+	}
+	return nil, 0, false
+}
+
 type sortvol struct {
-	score  []byte
-	volume string
+	score   []byte
+	wscore  float64
+	volume  string
+	domain  string
+	svcount int
 }
 type byScore []sortvol
 
 func (s byScore) Len() int      { return len(s) }
 func (s byScore) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
 func (s byScore) Less(i, j int) bool {
+	if s[i].wscore != s[j].wscore {
+		return s[i].wscore > s[j].wscore
+	}
 	return bytes.Compare(s[i].score, s[j].score) == 1
 }
 
-func key2volume(key []byte, volumes []string, count int, svcount int) []string {
+// weighted rendezvous hashing, a volume with twice the weight wins twice as often
+// score is the md5, treated as a number in (0, 1)
+func weighted_score(score []byte, weight float64) float64 {
+	u := (float64(binary.BigEndian.Uint64(score[:8])) + 0.5) / math.Exp2(64)
+	return -weight / math.Log(u)
+}
+
+func key2volume(key []byte, volumes []Volume, count int, svcount int) []string {
 	// this is an intelligent way to pick the volume server for a file
 	// stable in the volume server name (not position!)
 	// and if more are added the correct portion will move (yay md5!)
+	var writable []Volume
+	for _, v := range volumes {
+		if v.state != DRAINING {
+			writable = append(writable, v)
+		}
+	}
+	volumes = writable
+	weighted := false
+	for _, v := range volumes {
+		if v.weight != volumes[0].weight {
+			weighted = true
+		}
+	}
 	var sortvols []sortvol
 	for _, v := range volumes {
 		hash := md5.New()
 		hash.Write(key)
-		hash.Write([]byte(v))
+		hash.Write([]byte(v.name))
 		score := hash.Sum(nil)
-		sortvols = append(sortvols, sortvol{score, v})
+		wscore := 0.0
+		if weighted {
+			// if they are all the same, this is the same order
+			// but leaving it out keeps the placement exactly how it always was
+			wscore = weighted_score(score, v.weight)
+		}
+		svcount := svcount
+		if v.subvolumes != 0 {
+			svcount = v.subvolumes
+		}
+		sortvols = append(sortvols, sortvol{score, wscore, v.name, v.domain(), svcount})
 	}
 	sort.Stable(byScore(sortvols))
+	// spread the replicas over the failure domains, best score first
+	// if there aren't enough domains, the rest go to the best of what's left
+	var picked []sortvol
+	used := make([]bool, len(sortvols))
+	domains := map[string]bool{}
+	for i, sv := range sortvols {
+		if len(picked) < count && !domains[sv.domain] {
+			domains[sv.domain] = true
+			used[i] = true
+			picked = append(picked, sv)
+		}
+	}
+	for i, sv := range sortvols {
+		if len(picked) < count && !used[i] {
+			picked = append(picked, sv)
+		}
+	}
 	// go should have a map function
 	// this adds the subvolumes
 	var ret []string
-	for i := 0; i < count; i++ {
-		sv := sortvols[i]
+	for _, sv := range picked {
 		var volume string
-		if svcount == 1 {
+		if sv.svcount == 1 {
 			// if it's one, don't use the path structure for it
 			volume = sv.volume
 		} else {
@@ -110,7 +1168,7 @@ func key2volume(key []byte, volumes []string, count int, svcount int) []string {
 			// using only a byte would cause potential imbalance
 			svhash := uint(sv.score[12])<<24 + uint(sv.score[13])<<16 +
 				uint(sv.score[14])<<8 + uint(sv.score[15])
-			volume = fmt.Sprintf("%s/sv%02X", sv.volume, svhash%uint(svcount))
+			volume = fmt.Sprintf("%s/sv%02X", sv.volume, svhash%uint(sv.svcount))
 		}
 		ret = append(ret, volume)
 	}
@@ -118,6 +1176,87 @@ func key2volume(key []byte, volumes []string, count int, svcount int) []string {
 	return ret
 }
 
+// the urls of the files of a record on the volumes, the ones it's missing too
+// the key is where the record is in the database
+func rec2remotes(key []byte, rec Record) []string {
+	if ukey, _, ok := key2version(key); ok {
+		key = ukey
+	}
+	blob := rec2blob(key, rec)
+	var ret []string
+	for i, volume := range rec.rvolumes {
+		name := blob
+		if rec.data != 0 {
+			name = blob2shard(blob, rec, i)
+		}
+		if volume != "" {
+			ret = append(ret, fmt.Sprintf("http://%s%s", volume, layout2path(name, rec.layout)))
+		}
+	}
+	for _, volume := range rec.missing {
+		ret = append(ret, fmt.Sprintf("http://%s%s", volume, layout2path(blob, rec.layout)))
+	}
+	return ret
+}
+
+// the draining volumes the key is on
+func drained_from(rvolumes []string, draining []string) []string {
+	var ret []string
+	for _, rv := range rvolumes {
+		for _, v := range draining {
+			if strings.Split(rv, "/")[0] == v {
+				ret = append(ret, v)
+			}
+		}
+	}
+	return ret
+}
+
+// where the missing replicas of a key go, the best volumes it isn't on yet
+func repair_targets(rvolumes []string, kvolumes []string, missing int) []string {
+	var ret []string
+	for _, kv := range kvolumes {
+		if len(ret) == missing {
+			break
+		}
+		found := false
+		for _, rv := range rvolumes {
+			if rv == kv {
+				found = true
+			}
+		}
+		if !found {
+			ret = append(ret, kv)
+		}
+	}
+	return ret
+}
+
+// the volumes in the order of kvolumes, so a repaired key doesn't need a rebalance
+// the ones not in kvolumes go last
+func order_volumes(volumes []string, kvolumes []string) []string {
+	ret := []string{}
+	for _, kv := range kvolumes {
+		for _, v := range volumes {
+			if v == kv {
+				ret = append(ret, v)
+			}
+		}
+	}
+	for _, v := range volumes {
+		found := false
+		for _, kv := range kvolumes {
+			if v == kv {
+				found = true
+			}
+		}
+		if !found {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
 func needs_rebalance(volumes []string, kvolumes []string) bool {
 	if len(volumes) != len(kvolumes) {
 		return true
@@ -148,8 +1287,187 @@ func remote_delete(remote string) error {
 	return nil
 }
 
+// counts the bytes written to it
+type counter int64
+
+func (c *counter) Write(p []byte) (int, error) {
+	*c += counter(len(p))
+	return len(p), nil
+}
+
+// 507 Insufficient Storage
+var errFull = errors.New("remote_put: volume is full")
+
+// a remote that takes nothing for this long is given up on
+const putStall = 1 * time.Minute
+
+// a remote that fell behind the others, or stopped answering
+var errSlow = errors.New("remote_put: volume is too slow")
+
+// writes the body to all the remotes at the same time, the errors are in the same order
+// a remote that fails doesn't stop the others, and one that falls behind while quorum of them keep up is left out
+// once quorum of them are written, the others get as long again as that took
+func remote_put_all(remotes []string, length int64, body io.Reader, quorum int) []error {
+	if quorum < 1 {
+		quorum = 1
+	} else if quorum > len(remotes) {
+		quorum = len(remotes)
+	}
+	type result struct {
+		i   int
+		err error
+	}
+	start := time.Now()
+	errs := make([]error, len(remotes))
+	feeds := make([]chan []byte, len(remotes))
+	ends := make([]error, len(remotes))
+	prs := make([]*io.PipeReader, len(remotes))
+	cancels := make([]context.CancelFunc, len(remotes))
+	alive := make([]bool, len(remotes))
+	finished := make([]bool, len(remotes))
+	results := make(chan result, len(remotes))
+	for i, remote := range remotes {
+		pr, pw := io.Pipe()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		feeds[i], prs[i], cancels[i], alive[i] = make(chan []byte, 64), pr, cancel, true
+		go func(i int) {
+			// the chunks are shared, a remote that failed skips them
+			var err error
+			for chunk := range feeds[i] {
+				if err == nil {
+					_, err = pw.Write(chunk)
+				}
+			}
+			pw.CloseWithError(ends[i])
+		}(i)
+		go func(i int, remote string) {
+			err := remote_put_context(ctx, remote, length, pr)
+			// nothing reads the rest anymore
+			pr.CloseWithError(io.ErrClosedPipe)
+			results <- result{i, err}
+		}(i, remote)
+	}
+	collect := func(r result) {
+		if alive[r.i] {
+			finished[r.i], errs[r.i] = true, r.err
+		}
+	}
+	giveup := func(i int) {
+		alive[i], errs[i] = false, errSlow
+		prs[i].CloseWithError(errSlow)
+		cancels[i]()
+	}
+
+	// a full feed is a remote that is behind, which is fine while the others are too
+	send := func(i int, chunk []byte) {
+		select {
+		case feeds[i] <- chunk:
+			return
+		default:
+		}
+		for {
+			select {
+			case r := <-results:
+				collect(r)
+				continue
+			default:
+			}
+			break
+		}
+		keeping := 0
+		for j := range feeds {
+			if j != i && alive[j] && !finished[j] && len(feeds[j]) < cap(feeds[j]) {
+				keeping++
+			}
+		}
+		if keeping < quorum {
+			timer := time.NewTimer(putStall)
+			defer timer.Stop()
+			select {
+			case feeds[i] <- chunk:
+				return
+			case <-timer.C:
+			}
+		}
+		giveup(i)
+		ends[i] = errSlow
+		close(feeds[i])
+	}
+
+	var rerr error
+	for {
+		chunk := make([]byte, 32*1024)
+		n, err := body.Read(chunk)
+		for i := range feeds {
+			if alive[i] && !finished[i] && n > 0 {
+				send(i, chunk[:n])
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				rerr = err
+			}
+			break
+		}
+	}
+	pending := 0
+	for i := range feeds {
+		if alive[i] {
+			ends[i] = rerr
+			close(feeds[i])
+			if !finished[i] {
+				pending++
+			}
+		}
+	}
+
+	written := 0
+	for i := range errs {
+		if finished[i] && errs[i] == nil {
+			written++
+		}
+	}
+	deadline := time.NewTimer(putStall)
+	defer deadline.Stop()
+	var grace <-chan time.Time
+	for pending > 0 {
+		select {
+		case r := <-results:
+			if !alive[r.i] || finished[r.i] {
+				continue
+			}
+			collect(r)
+			pending--
+			if r.err == nil {
+				if written++; written == quorum {
+					timer := time.NewTimer(time.Since(start))
+					defer timer.Stop()
+					grace = timer.C
+				}
+			}
+			continue
+		case <-deadline.C:
+		case <-grace:
+		}
+		for i := range remotes {
+			if alive[i] && !finished[i] {
+				giveup(i)
+			}
+		}
+		break
+	}
+	return errs
+}
+
+// a length of -1 sends the body chunked
 func remote_put(remote string, length int64, body io.Reader) error {
-	req, err := http.NewRequest("PUT", remote, body)
+	return remote_put_context(context.Background(), remote, length, body)
+}
+
+// the same, and cancelling the context stops it
+func remote_put_context(ctx context.Context, remote string, length int64, body io.Reader) error {
+	req, err := http.NewRequestWithContext(ctx, "PUT", remote, body)
 	if err != nil {
 		return err
 	}
@@ -159,12 +1477,63 @@ func remote_put(remote string, length int64, body io.Reader) error {
 		return err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode == 507 {
+		return errFull
+	}
 	if resp.StatusCode != 201 && resp.StatusCode != 204 {
 		return fmt.Errorf("remote_put: wrong status code %d", resp.StatusCode)
 	}
 	return nil
 }
 
+// reads the file back, and checks it has the size and checksum it should
+// all the remotes at the same time, with an empty hexsum only the size is checked
+func remote_verify_all(remotes []string, size int64, alg string, hexsum string) []error {
+	errs := make([]error, len(remotes))
+	var wg sync.WaitGroup
+	for i, remote := range remotes {
+		wg.Add(1)
+		go func(i int, remote string) {
+			defer wg.Done()
+			body, err := remote_open(remote)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer body.Close()
+			var n counter
+			var h hash.Hash
+			w := io.Writer(&n)
+			if hexsum != "" {
+				h = checksums[alg]()
+				w = io.MultiWriter(&n, h)
+			}
+			if _, err := io.Copy(w, body); err != nil {
+				errs[i] = err
+			} else if int64(n) != size {
+				errs[i] = fmt.Errorf("remote_verify: size is %d, not %d", n, size)
+			} else if h != nil && hex.EncodeToString(h.Sum(nil)) != hexsum {
+				errs[i] = fmt.Errorf("remote_verify: %s checksum mismatch", alg)
+			}
+		}(i, remote)
+	}
+	wg.Wait()
+	return errs
+}
+
+// the body of the remote, which has to be closed
+func remote_open(remote string) (io.ReadCloser, error) {
+	resp, err := http.Get(remote)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("remote_open: wrong status code %d", resp.StatusCode)
+	}
+	return resp.Body, nil
+}
+
 func remote_get(remote string) (string, error) {
 	resp, err := http.Get(remote)
 	if err != nil {
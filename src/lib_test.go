@@ -1,10 +1,15 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
+	"io/ioutil"
+	"net/http"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 // ensure the path hashing function doesn't change
@@ -21,9 +26,37 @@ func Test_key2path(t *testing.T) {
 	}
 }
 
+// every layout maps back to the key it was made from
+func Test_layout2path(t *testing.T) {
+	for _, key := range []string{"/hello", "/helloworld", "/a?b", "/\xff\xfe\xfd", "/\xfb\xff\xbf/\xfb\xff"} {
+		for layout := 0; layout <= maxLayout; layout++ {
+			path := layout2path([]byte(key), layout)
+			if layout != 0 && strings.Count(path, "/") != layout+1 {
+				t.Fatal("layout2path made directories", key, layout, path)
+			}
+			k, l, ok := path2key(path)
+			if !ok || string(k) != key || (l != layout && layout2path(k, l) != path) {
+				t.Fatal("path2key broke", key, layout, path, string(k), l, ok)
+			}
+		}
+	}
+	if layout2path([]byte("/hello"), 0) != key2path([]byte("/hello")) {
+		t.Fatal("layout 0 isn't key2path")
+	}
+	// the old layout with a / in the base64
+	if path := key2path([]byte("/\xfb\xff\xbf/\xfb\xff")); strings.Count(path, "/") <= 3 {
+		t.Fatal("expected a / in", path)
+	}
+	for _, bad := range []string{"/aa/bb", "/aa/bb/L2hlbGxv", "/zz/L2hlbGxv", "/L2hlbGxv"} {
+		if _, _, ok := path2key(bad); ok {
+			t.Fatal("path2key accepted", bad)
+		}
+	}
+}
+
 // ensure the volume hashing function doesn't change
 func Test_key2volume(t *testing.T) {
-	volumes := []string{"larry", "moe", "curly"}
+	volumes := []Volume{{name: "larry", weight: 1}, {name: "moe", weight: 1}, {name: "curly", weight: 1}}
 	tests := map[string]string{
 		"hello":      "larry",
 		"helloworld": "curly",
@@ -36,25 +69,491 @@ func Test_key2volume(t *testing.T) {
 			t.Fatal("key2volume function broke", k, ret, v)
 		}
 	}
+
+	// equal weights don't change anything
+	ret := key2volume([]byte("hello"), []Volume{{name: "larry", weight: 2}, {name: "moe", weight: 2}, {name: "curly", weight: 2}}, 1, 3)
+	if strings.Split(ret[0], "/")[0] != "larry" {
+		t.Fatal("key2volume equal weights broke", ret)
+	}
+}
+
+func Test_key2volume_weighted(t *testing.T) {
+	volumes := []Volume{{name: "larry", weight: 1}, {name: "moe", weight: 1}, {name: "curly", weight: 2}}
+	counts := map[string]int{}
+	for i := 0; i < 10000; i++ {
+		ret := key2volume([]byte(fmt.Sprintf("key%d", i)), volumes, 1, 1)
+		counts[ret[0]]++
+	}
+	// curly should have about half
+	if counts["curly"] < 4500 || counts["curly"] > 5500 {
+		t.Fatal("key2volume weights broke", counts)
+	}
+}
+
+func Test_key2volume_zones(t *testing.T) {
+	volumes := []Volume{
+		{name: "a1", weight: 1, zone: "a"}, {name: "a2", weight: 1, zone: "a"}, {name: "a3", weight: 1, zone: "a"},
+		{name: "b1", weight: 1, zone: "b"}, {name: "b2", weight: 1, zone: "b"},
+		{name: "c1", weight: 1, zone: "c"},
+	}
+	for i := 0; i < 1000; i++ {
+		ret := key2volume([]byte(fmt.Sprintf("key%d", i)), volumes, 3, 1)
+		zones := map[byte]bool{}
+		for _, v := range ret {
+			zones[v[0]] = true
+		}
+		if len(zones) != 3 {
+			t.Fatal("key2volume zones broke", ret)
+		}
+	}
+
+	// more replicas than zones still gives distinct volumes
+	ret := key2volume([]byte("hello"), volumes[:5], 4, 1)
+	seen := map[string]bool{}
+	for _, v := range ret {
+		seen[v] = true
+	}
+	if len(ret) != 4 || len(seen) != 4 || ret[0][0] == ret[1][0] {
+		t.Fatal("key2volume zones fill broke", ret)
+	}
+}
+
+func Test_key2policy(t *testing.T) {
+	policies, err := parse_policies("/scratch/=1,/datasets/=3,/datasets/small/=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]int{
+		"/scratch/a":          1,
+		"/datasets/big/x":     3,
+		"/datasets/small/x":   2,
+		"/scratch":            0,
+		"/somewhere/scratch/": 0,
+	}
+	for k, v := range tests {
+		p, ok := key2policy([]byte(k), policies)
+		if ok != (v != 0) || p.replicas != v {
+			t.Fatal("key2policy broke", k, p, v)
+		}
+	}
+	for _, bad := range []string{"/scratch/", "scratch/=1", "/scratch/=x", "/a/=1,/a/=2", "/a/=-1", "/x/=0"} {
+		if _, err := parse_policies(bad); err == nil {
+			t.Fatal("parse_policies accepted", bad)
+		}
+	}
+}
+
+func Test_blob2shard(t *testing.T) {
+	rec := Record{data: 6, parity: 3, size: 12345}
+	for _, blob := range []string{"/hello", "/hello\x00version", "/hello\x00version\x01sha256:abcd"} {
+		for i := 0; i < 9; i++ {
+			b, srec, index := shard2blob(blob2shard([]byte(blob), rec, i))
+			if string(b) != blob || index != i || !reflect.DeepEqual(srec, rec) {
+				t.Fatal("blob2shard broke", blob, i, string(b), srec, index)
+			}
+		}
+		if _, _, index := shard2blob([]byte(blob)); index != -1 {
+			t.Fatal("shard2blob found a shard in", blob)
+		}
+	}
+	if _, _, index := shard2blob([]byte("/hello\x026,3,9,100")); index != -1 {
+		t.Fatal("shard2blob accepted a shard past the end")
+	}
+
+	for s, ok := range map[string]bool{"6,3": true, "1,1": true, "6": false, "0,3": false, "6,0": false, "6,3,1": false, "a,b": false} {
+		if _, _, err := parse_erasure(s); (err == nil) != ok {
+			t.Fatal("parse_erasure broke", s, err)
+		}
+	}
+}
+
+func Test_key2volume_draining(t *testing.T) {
+	volumes := []Volume{{name: "larry", weight: 1}, {name: "moe", weight: 1}, {name: "curly", weight: 1, state: DRAINING}}
+	for i := 0; i < 100; i++ {
+		ret := key2volume([]byte(fmt.Sprintf("key%d", i)), volumes, 2, 10)
+		if len(drained_from(ret, []string{"curly"})) != 0 {
+			t.Fatal("key2volume picked a draining volume", ret)
+		}
+	}
+	if !reflect.DeepEqual(drained_from([]string{"larry/sv01", "curly/sv02"}, []string{"curly"}), []string{"curly"}) {
+		t.Fatal("drained_from broke")
+	}
+}
+
+func Test_repair_targets(t *testing.T) {
+	kvolumes := []string{"larry", "moe", "curly"}
+	if ret := repair_targets([]string{"moe"}, kvolumes, 2); !reflect.DeepEqual(ret, []string{"larry", "curly"}) {
+		t.Fatal("repair_targets broke", ret)
+	}
+	if ret := repair_targets([]string{"shemp", "moe"}, kvolumes, 1); !reflect.DeepEqual(ret, []string{"larry"}) {
+		t.Fatal("repair_targets broke", ret)
+	}
+	if ret := order_volumes([]string{"shemp", "curly", "larry"}, kvolumes); !reflect.DeepEqual(ret, []string{"larry", "curly", "shemp"}) {
+		t.Fatal("order_volumes broke", ret)
+	}
+}
+
+func Test_rec2remotes(t *testing.T) {
+	rec := Record{rvolumes: []string{"larry", "moe"}, missing: []string{"curly"}, layout: 0}
+	if ret := rec2remotes([]byte("swag"), rec); !reflect.DeepEqual(ret, []string{
+		"http://larry" + key2path([]byte("swag")),
+		"http://moe" + key2path([]byte("swag")),
+		"http://curly" + key2path([]byte("swag"))}) {
+		t.Fatal("rec2remotes broke", ret)
+	}
+	rec = Record{rvolumes: []string{"larry", "", "curly"}, data: 2, parity: 1, size: 10, version: "v1"}
+	ret := rec2remotes(version2key([]byte("swag"), "v1"), rec)
+	if len(ret) != 2 || ret[1] != "http://curly"+key2path(blob2shard(rec2blob([]byte("swag"), rec), rec, 2)) {
+		t.Fatal("rec2remotes broke for shards", ret)
+	}
+}
+
+// a key written before -versioned keeps its value when it's first versioned
+func Test_unversioned2version(t *testing.T) {
+	key := []byte("swag")
+	rec := Record{rvolumes: []string{"larry"}, deleted: NO, size: 5}
+	ret, ok := unversioned2version(rec)
+	if !ok || ret.version != nullVersion || string(rec2blob(key, ret)) != string(rec2blob(key, rec)) {
+		t.Fatal("unversioned2version moved the value", ret, ok)
+	}
+	if nullVersion >= new_version() {
+		t.Fatal("the null version isn't the oldest")
+	}
+	// an overwritten one is already named by its version
+	rec = Record{rvolumes: []string{"larry"}, deleted: NO, version: "v1"}
+	if ret, ok := unversioned2version(rec); !ok || ret.version != "v1" {
+		t.Fatal("unversioned2version renamed the version", ret, ok)
+	}
+	// an unlinked one stays deleted
+	rec = Record{rvolumes: []string{"larry"}, deleted: SOFT, unlinked: 1}
+	if ret, ok := unversioned2version(rec); !ok || ret.deleted != SOFT {
+		t.Fatal("unversioned2version undeleted", ret, ok)
+	}
+	for _, rec := range []Record{
+		{rvolumes: []string{}, deleted: HARD},
+		{rvolumes: []string{"larry"}, deleted: SOFT},
+		{rvolumes: []string{}, deleted: NO, version: "v1"},
+	} {
+		if ret, ok := unversioned2version(rec); ok {
+			t.Fatal("unversioned2version kept", rec, ret)
+		}
+	}
+}
+
+func Test_blob2codec(t *testing.T) {
+	rec := Record{version: "v1", codec: "zstd"}
+	blob, codec := blob2codec(rec2blob([]byte("swag"), rec))
+	if codec != "zstd" || string(blob) != "swag\x00v1" {
+		t.Fatal("blob2codec broke", blob, codec)
+	}
+	if blob, codec := blob2codec([]byte("swag\x03gzip")); codec != "" || string(blob) != "swag\x03gzip" {
+		t.Fatal("blob2codec took an unknown codec", blob, codec)
+	}
+}
+
+func Test_accepts_encoding(t *testing.T) {
+	tests := map[string]bool{
+		"zstd":                   true,
+		"gzip, deflate, zstd":    true,
+		"gzip;q=1.0, zstd;q=0.5": true,
+		"zstd;q=0":               false,
+		"gzip":                   false,
+		"":                       false,
+	}
+	for header, ok := range tests {
+		if accepts_encoding(header, "zstd") != ok {
+			t.Fatal("accepts_encoding broke", header)
+		}
+	}
+}
+
+func Test_parse_keyfile(t *testing.T) {
+	keys, current, err := parse_keyfile([]byte("# old one first\nk1 " + strings.Repeat("00", 32) + "\n\nk2 " + strings.Repeat("ff", 32) + "\n"))
+	if err != nil || current != "k2" || len(keys) != 2 || keys["k2"][0] != 0xff {
+		t.Fatal("parse_keyfile broke", keys, current, err)
+	}
+	for _, bad := range []string{"", "k1", "k1 00", "k1 " + strings.Repeat("zz", 32), "k1 " + strings.Repeat("00", 32) + "\nk1 " + strings.Repeat("00", 32)} {
+		if _, _, err := parse_keyfile([]byte(bad)); err == nil {
+			t.Fatal("parse_keyfile accepted", bad)
+		}
+	}
+}
+
+func Test_encrypt_reader(t *testing.T) {
+	master, dk := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+	wrapped, err := wrap_key(master, dk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unwrapped, err := unwrap_key(master, wrapped); err != nil || !bytes.Equal(unwrapped, dk) {
+		t.Fatal("unwrap_key broke", err)
+	}
+	if _, err := unwrap_key(dk, wrapped); err == nil {
+		t.Fatal("unwrap_key took the wrong key")
+	}
+
+	for _, size := range []int{0, 1, encChunk, encChunk + 1, 3 * encChunk} {
+		value := bytes.Repeat([]byte("swag"), size/4+1)[:size]
+		stored, err := ioutil.ReadAll(encrypt_reader(bytes.NewReader(value), dk, encrypt_header("k1", wrapped)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		br := bufio.NewReader(bytes.NewReader(stored))
+		keyid, hwrapped, err := read_encrypt_header(br)
+		if err != nil || keyid != "k1" || !bytes.Equal(hwrapped, wrapped) {
+			t.Fatal("read_encrypt_header broke", keyid, err)
+		}
+		rest, _ := ioutil.ReadAll(br)
+		if plain, err := ioutil.ReadAll(decrypt_reader(bytes.NewReader(rest), dk)); err != nil || !bytes.Equal(plain, value) {
+			t.Fatal("decrypt_reader broke", size, err)
+		}
+		if size > encChunk {
+			// missing the last chunk
+			if _, err := ioutil.ReadAll(decrypt_reader(bytes.NewReader(rest[:encChunk+16]), dk)); err == nil {
+				t.Fatal("decrypt_reader took a value cut short", size)
+			}
+		}
+		rest[len(rest)-1] ^= 1
+		if _, err := ioutil.ReadAll(decrypt_reader(bytes.NewReader(rest), dk)); err == nil {
+			t.Fatal("decrypt_reader took a changed value", size)
+		}
+	}
+
+	blob, ok := blob2cipher(rec2blob([]byte("swag"), Record{codec: "zstd", keyid: "k1"}))
+	if !ok || string(blob) != "swag\x03zstd" {
+		t.Fatal("blob2cipher broke", blob)
+	}
+}
+
+func Test_parse_volumes(t *testing.T) {
+	volumes, err := parse_volumes("localhost:3001,localhost:3002=2.5,localhost:3003@rack1,localhost:3004@rack2=3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(volumes, []Volume{
+		{name: "localhost:3001", weight: 1, state: ACTIVE},
+		{name: "localhost:3002", weight: 2.5, state: ACTIVE},
+		{name: "localhost:3003", weight: 1, zone: "rack1", state: ACTIVE},
+		{name: "localhost:3004", weight: 3, zone: "rack2", state: ACTIVE},
+	}) {
+		t.Fatal("parse_volumes broke", volumes)
+	}
+	for _, bad := range []string{"localhost:3001=0", "localhost:3001=-1", "localhost:3001=x", "localhost:3001@", "localhost:3001,localhost:3001"} {
+		if _, err := parse_volumes(bad); err == nil {
+			t.Fatal("parse_volumes accepted", bad)
+		}
+	}
 }
 
-func fromToRecordExample(t *testing.T, rec Record, val string) {
+func Test_parse_topology(t *testing.T) {
+	volumes, policies, err := parse_topology([]byte(`{"policies": [{"prefix": "/scratch/", "replicas": 1}, {"prefix": "/logs/", "compress": "zstd"}], "volumes": [
+		{"host": "localhost:3001", "zone": "rack1", "subvolumes": 4},
+		{"host": "localhost:3002", "weight": 2, "state": "active"},
+		{"host": "localhost:3003", "state": "draining"}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(volumes, []Volume{
+		{name: "localhost:3001", weight: 1, zone: "rack1", subvolumes: 4, state: ACTIVE},
+		{name: "localhost:3002", weight: 2, state: ACTIVE},
+		{name: "localhost:3003", weight: 1, state: DRAINING},
+	}) {
+		t.Fatal("parse_topology broke", volumes)
+	}
+	if !reflect.DeepEqual(policies, []Policy{{prefix: "/scratch/", replicas: 1}, {prefix: "/logs/", compress: "zstd"}}) {
+		t.Fatal("parse_topology policies broke", policies)
+	}
+	for _, bad := range []string{
+		`{"volumes": []}`,
+		`{"volumes": [{"weight": 2}]}`,
+		`{"volumes": [{"host": "localhost:3001", "weight": -1}]}`,
+		`{"volumes": [{"host": "localhost:3001", "subvolumes": -1}]}`,
+		`{"volumes": [{"host": "localhost:3001", "state": "broken"}]}`,
+		`{"volumes": [{"host": "localhost:3001", "disks": 4}]}`,
+		`{"volumes": [{"host": "localhost:3001"}, {"host": "localhost:3001"}]}`,
+		`{"volumes": [{"host": "localhost:3001"}], "policies": [{"prefix": "scratch", "replicas": 1}]}`,
+		`{"volumes": [{"host": "localhost:3001"}], "policies": [{"prefix": "/logs/", "compress": "gzip"}]}`,
+		`{"volumes": [{"host": "localhost:3001"}], "policies": [{"prefix": "/logs/"}]}`,
+	} {
+		if _, _, err := parse_topology([]byte(bad)); err == nil {
+			t.Fatal("parse_topology accepted", bad)
+		}
+	}
+
+	// subvolumes per volume
+	ret := key2volume([]byte("hello"), volumes, 2, 10)
+	for _, v := range ret {
+		if strings.HasPrefix(v, "localhost:3001/") && v[len(v)-2:] > "03" {
+			t.Fatal("key2volume subvolumes broke", ret)
+		}
+	}
+}
+
+func fromToRecordExample(t *testing.T, rec Record) {
 	recs := fromRecord(rec)
-	if val != string(recs) {
-		t.Fatal("record string didn't match")
+	if record_version(recs) != recordVersion {
+		t.Fatal("record didn't start with the version byte")
 	}
 	reca := toRecord(recs)
 	if !reflect.DeepEqual(rec, reca) {
 		t.Fatal("toRecord(fromRecord(rec)) failed")
 	}
-	fmt.Println(val)
+	fmt.Println(string(recs[1:]))
 }
 
 func Test_fromToRecord(t *testing.T) {
-	fromToRecordExample(t, Record{[]string{"hello", "world"}, SOFT, ""}, "DELETEDhello,world")
-	fromToRecordExample(t, Record{[]string{"hello", "world"}, NO, ""}, "hello,world")
-	fromToRecordExample(t, Record{[]string{"hello"}, NO, ""}, "hello")
-	fromToRecordExample(t, Record{[]string{"hello"}, SOFT, ""}, "DELETEDhello")
-	fromToRecordExample(t, Record{[]string{"hello"}, SOFT, "5d41402abc4b2a76b9719d911017c592"}, "DELETEDHASH5d41402abc4b2a76b9719d911017c592hello")
-	fromToRecordExample(t, Record{[]string{"hello"}, NO, "5d41402abc4b2a76b9719d911017c592"}, "HASH5d41402abc4b2a76b9719d911017c592hello")
+	fromToRecordExample(t, Record{rvolumes: []string{"hello", "world"}, deleted: SOFT})
+	fromToRecordExample(t, Record{rvolumes: []string{"hello", "world"}, deleted: NO})
+	fromToRecordExample(t, Record{rvolumes: []string{"hello"}, deleted: NO})
+	fromToRecordExample(t, Record{rvolumes: []string{"hello"}, deleted: SOFT})
+	fromToRecordExample(t, Record{rvolumes: []string{"hello"}, deleted: SOFT, hash: "5d41402abc4b2a76b9719d911017c592", hashalg: "md5"})
+	fromToRecordExample(t, Record{rvolumes: []string{"hello"}, deleted: NO, hash: "5d41402abc4b2a76b9719d911017c592", hashalg: "md5"})
+	// these used to be ambiguous
+	fromToRecordExample(t, Record{rvolumes: []string{"hello,world"}, deleted: NO})
+	fromToRecordExample(t, Record{rvolumes: []string{"HASHhello"}, deleted: NO})
+	fromToRecordExample(t, Record{rvolumes: []string{"hello"}, deleted: NO, hash: "5d41402abc4b2a76b9719d911017c592",
+		size: 5, mtime: 1638835200, ctype: "text/plain"})
+	fromToRecordExample(t, Record{rvolumes: []string{"hello"}, deleted: NO, meta: map[string]string{"camera": "road"}})
+	fromToRecordExample(t, Record{rvolumes: []string{"hello"}, deleted: NO,
+		hash: "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", hashalg: "sha256"})
+}
+
+// ensure records written by older versions still decode
+func Test_toLegacyRecord(t *testing.T) {
+	tests := map[string]Record{
+		"DELETEDhello,world": {rvolumes: []string{"hello", "world"}, deleted: SOFT},
+		"hello,world":        {rvolumes: []string{"hello", "world"}, deleted: NO},
+		"hello":              {rvolumes: []string{"hello"}, deleted: NO},
+		"DELETEDhello":       {rvolumes: []string{"hello"}, deleted: SOFT},
+		"DELETEDHASH5d41402abc4b2a76b9719d911017c592hello": {rvolumes: []string{"hello"}, deleted: SOFT, hash: "5d41402abc4b2a76b9719d911017c592", hashalg: "md5"},
+		"HASH5d41402abc4b2a76b9719d911017c592hello":        {rvolumes: []string{"hello"}, deleted: NO, hash: "5d41402abc4b2a76b9719d911017c592", hashalg: "md5"},
+	}
+	for k, v := range tests {
+		if record_version([]byte(k)) != 0 {
+			t.Fatal("legacy record has a version", k)
+		}
+		rec := toRecord([]byte(k))
+		if !reflect.DeepEqual(rec, v) {
+			t.Fatal("legacy record decode broke", k, rec, v)
+		}
+	}
+}
+
+func Test_header2meta(t *testing.T) {
+	header := http.Header{}
+	header.Set("X-Mkv-Meta-Camera", "road")
+	header.Set("x-amz-meta-route", "r1")
+	header.Set("Content-Type", "text/plain")
+	meta, err := header2meta(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(meta, map[string]string{"camera": "road", "route": "r1"}) {
+		t.Fatal("header2meta broke", meta)
+	}
+
+	header.Set("X-Mkv-Meta-Big", strings.Repeat("a", maxMetaSize))
+	if _, err := header2meta(header); err == nil {
+		t.Fatal("header2meta allowed too much metadata")
+	}
+}
+
+// the sums of the initiate request aren't of the value
+func Test_upload_header(t *testing.T) {
+	header := http.Header{}
+	header.Set("Content-Type", "text/plain")
+	header.Set("X-Amz-Meta-Route", "r1")
+	header.Set("X-Mkv-Ttl", "1h")
+	header.Set("X-Amz-Content-Sha256", "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855")
+	header.Set("Content-Md5", "1B2M2Y8AsgTpgAmY7PhCfg==")
+	header.Set("X-Amz-Checksum-Crc32", "AAAAAA==")
+	header.Set("Digest", "sha-256=47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=")
+	ret := upload_header(header)
+	if !reflect.DeepEqual(ret, http.Header{"Content-Type": {"text/plain"}, "X-Amz-Meta-Route": {"r1"}, "X-Mkv-Ttl": {"1h"}}) {
+		t.Fatal("upload_header broke", ret)
+	}
+	if sums, err := header2checksums(ret); err != nil || len(sums) != 0 {
+		t.Fatal("upload_header kept checksums", sums, err)
+	}
+}
+
+func Test_header2checksums(t *testing.T) {
+	header := http.Header{}
+	header.Set("Digest", "sha-256=LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=, unixsum=30637")
+	header.Set("X-Amz-Checksum-Crc32c", "mnG7TA==")
+	sums, err := header2checksums(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sums) != 2 {
+		t.Fatal("header2checksums broke", sums)
+	}
+	for alg, sum := range sums {
+		h := checksums[alg]()
+		h.Write([]byte("hello"))
+		if !reflect.DeepEqual(h.Sum(nil), sum) {
+			t.Fatal("checksum mismatch", alg)
+		}
+	}
+
+	header = http.Header{}
+	header.Set("Content-MD5", "XUFAKrxLKna5cZ2REBfFkg==")
+	header.Set("X-Amz-Content-Sha256", "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824")
+	if sums, err = header2checksums(header); err != nil || len(sums) != 2 {
+		t.Fatal("header2checksums broke", sums, err)
+	}
+	header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+	if sums, err = header2checksums(header); err != nil || len(sums) != 1 {
+		t.Fatal("header2checksums broke", sums, err)
+	}
+	header.Set("Digest", "md5=AAAAAAAAAAAAAAAAAAAAAA==")
+	if _, err = header2checksums(header); err == nil {
+		t.Fatal("header2checksums took conflicting checksums")
+	}
+}
+
+func Test_header2expires(t *testing.T) {
+	now := time.Unix(1638835200, 0)
+	tests := map[string]int64{
+		"X-Mkv-Ttl=3600": 1638838800,
+		"X-Mkv-Ttl=1h":   1638838800,
+		"X-Mkv-Expires=Tue, 07 Dec 2021 01:00:00 GMT": 1638838800,
+		"": 0,
+	}
+	for k, v := range tests {
+		header := http.Header{}
+		if kv := strings.SplitN(k, "=", 2); len(kv) == 2 {
+			header.Set(kv[0], kv[1])
+		}
+		expires, err := header2expires(header, now)
+		if err != nil || expires != v {
+			t.Fatal("header2expires broke", k, expires, err)
+		}
+	}
+
+	ekey := time2key(expiryPrefix, 1638838800, []byte("/hello"))
+	if expires, key := key2time(expiryPrefix, ekey); expires != 1638838800 || string(key) != "/hello" {
+		t.Fatal("expiry key broke", expires, string(key))
+	}
+}
+
+func Test_etag_match(t *testing.T) {
+	hash := "5d41402abc4b2a76b9719d911017c592"
+	tests := map[string]bool{
+		"*":                                    true,
+		`"5d41402abc4b2a76b9719d911017c592"`:   true,
+		`W/"5d41402abc4b2a76b9719d911017c592"`: true,
+		`"abc", "5d41402abc4b2a76b9719d911017c592"`: true,
+		`"abc"`: false,
+		`""`:    false,
+	}
+	for k, v := range tests {
+		if etag_match(k, hash) != v {
+			t.Fatal("etag_match broke", k)
+		}
+	}
+	if etag_match(`""`, "") {
+		t.Fatal("etag_match matched a missing hash")
+	}
 }
@@ -7,7 +7,6 @@ import (
 	"log"
 	"math/rand"
 	"net/http"
-	"strings"
 	"sync"
 	"time"
 
@@ -22,13 +21,27 @@ type App struct {
 	lock  map[string]struct{}
 
 	// params
-	uploadids  map[string]bool
-	volumes    []string
+	uploadids  map[string]http.Header
+	volumes    []Volume
+	readonly   map[string]bool // volumes that filled up, until there's room on them again
+	policies   []Policy
+	data       int // erasure coding, zero to replicate
+	parity     int
+	layout     int // of the paths of new values
+	quorum     int // replicas a write needs, zero for all of them
+	verify     bool
+	compress   string            // codec of new values, empty to store them as they are
+	keys       map[string][]byte // master keys by id, nil to not encrypt
+	keyid      string            // the one that wraps new data keys
+	spooldir   string
 	fallback   string
 	replicas   int
 	subvolumes int
 	protect    bool
-	md5sum     bool
+	versioned  bool
+	dedup      bool
+	retention  time.Duration
+	checksum   string
 	voltimeout time.Duration
 }
 
@@ -50,7 +63,7 @@ func (a *App) LockKey(key []byte) bool {
 
 func (a *App) GetRecord(key []byte) Record {
 	data, err := a.db.Get(key, nil)
-	rec := Record{[]string{}, HARD, ""}
+	rec := Record{rvolumes: []string{}, deleted: HARD}
 	if err != leveldb.ErrNotFound {
 		rec = toRecord(data)
 	}
@@ -71,19 +84,60 @@ func main() {
 	pdb := flag.String("db", "", "Path to leveldb")
 	fallback := flag.String("fallback", "", "Fallback server for missing keys")
 	replicas := flag.Int("replicas", 3, "Amount of replicas to make of the data")
+	quorum := flag.Int("quorum", 0, "Amount of replicas a PUT must write, the others are repaired in the background, default is all of them")
 	subvolumes := flag.Int("subvolumes", 10, "Amount of subvolumes, disks per machine")
-	pvolumes := flag.String("volumes", "", "Volumes to use for storage, comma separated")
+	pvolumes := flag.String("volumes", "", "Volumes to use for storage, comma separated, with optional zones and weights like host:port@rack1=2")
+	ppolicies := flag.String("policies", "", "Replicas for keys with a prefix, comma separated, like /scratch/=1")
+	erasure := flag.String("erasure", "", "Split values into data and parity shards instead of replicating them, like 6,3")
+	compress := flag.String("compress", "none", "Compress values on the volumes with this codec, zstd or none, policies in the topology can set it for a prefix")
+	keyfile := flag.String("keyfile", "", "Encrypt values with keys wrapped by the last master key in this file, one id and 64 hex digits per line")
+	layout := flag.Int("layout", 2, "Path layout of new values on the volumes, 0 for the old one with standard base64, otherwise how many directories deep")
+	spooldir := flag.String("spooldir", "", "Directory for values that are read before they are written, with -dedup or -erasure, default is the temp directory")
+	topology := flag.String("topology", "", "Topology file describing the volumes, instead of -volumes")
+	verify := flag.Bool("verify-writes", false, "Read every value back from the volumes before a PUT returns 201")
 	protect := flag.Bool("protect", false, "Force UNLINK before DELETE")
+	dedup := flag.Bool("dedup", false, "Store identical values once, needs -checksum sha256 or blake3")
+	versioned := flag.Bool("versioned", false, "Keep every version of every key, DELETE adds a delete marker")
 	verbose := flag.Bool("v", false, "Verbose output")
-	md5sum := flag.Bool("md5sum", true, "Calculate and store MD5 checksum of values")
+	md5sum := flag.Bool("md5sum", true, "Calculate and store checksum of values, false is the same as -checksum none")
+	checksum := flag.String("checksum", "md5", "Checksum of values to store, one of md5, sha256, crc32c, blake3 or none")
+	retention := flag.Duration("unlink-retention", 0, "Delete unlinked keys this long after UNLINK, and with -protect not before, as duration")
+	reapinterval := flag.Duration("reapinterval", 1*time.Minute, "How often to delete expired keys, as duration")
+	repairinterval := flag.Duration("repairinterval", 1*time.Minute, "How often to write the replicas that quorum writes left out, delete what failed writes left behind, and check if full volumes have room again, as duration")
 	voltimeout := flag.Duration("voltimeout", 1*time.Second, "Volume servers must respond to GET/HEAD requests in this amount of time or they are considered down, as duration")
 	flag.Parse()
 
-	volumes := strings.Split(*pvolumes, ",")
+	var volumes []Volume
+	var policies []Policy
+	var err error
+	if *topology != "" {
+		if *pvolumes != "" {
+			panic("Use -volumes or -topology, not both")
+		}
+		data, err := ioutil.ReadFile(*topology)
+		if err != nil {
+			panic(err)
+		}
+		if volumes, policies, err = parse_topology(data); err != nil {
+			panic(err)
+		}
+	} else if *pvolumes != "" {
+		if volumes, err = parse_volumes(*pvolumes); err != nil {
+			panic(err)
+		}
+	}
+	if *ppolicies != "" {
+		if len(policies) != 0 {
+			panic("Use -policies or policies in the topology, not both")
+		}
+		if policies, err = parse_policies(*ppolicies); err != nil {
+			panic(err)
+		}
+	}
 	command := flag.Arg(0)
 
-	if command != "server" && command != "rebuild" && command != "rebalance" {
-		fmt.Println("Usage: ./mkv <server, rebuild, rebalance>")
+	if command != "server" && command != "rebuild" && command != "rebalance" && command != "migrate-index" && command != "migrate-layout" && command != "rewrap" {
+		fmt.Println("Usage: ./mkv <server, rebuild, rebalance, migrate-index, migrate-layout, rewrap>")
 		flag.PrintDefaults()
 		return
 	}
@@ -98,8 +152,79 @@ func main() {
 		panic("Need a path to the database")
 	}
 
-	if len(volumes) < *replicas {
-		panic("Need at least as many volumes as replicas")
+	shards, parity := 0, 0
+	if *erasure != "" {
+		if shards, parity, err = parse_erasure(*erasure); err != nil {
+			panic(err)
+		}
+	}
+
+	// migrate-index and rewrap only touch the database
+	dbonly := command == "migrate-index" || command == "rewrap"
+	writable := 0
+	for _, v := range volumes {
+		if v.state == ACTIVE {
+			writable++
+		}
+	}
+	if !dbonly && writable < *replicas {
+		panic("Need at least as many volumes as replicas, not counting draining or read-only ones")
+	}
+	if !dbonly && writable < shards+parity {
+		panic("Need at least as many volumes as erasure coding shards")
+	}
+	for _, p := range policies {
+		if !dbonly && writable < p.count() {
+			panic(fmt.Sprintf("Need at least as many volumes as replicas or shards for %s", p.prefix))
+		}
+		if *dedup && p.data != 0 {
+			panic("Dedup and erasure coding don't mix")
+		}
+	}
+	if *dedup && shards != 0 {
+		panic("Dedup and erasure coding don't mix")
+	}
+	var keys map[string][]byte
+	keyid := ""
+	if *keyfile != "" {
+		data, err := ioutil.ReadFile(*keyfile)
+		if err != nil {
+			panic(err)
+		}
+		if keys, keyid, err = parse_keyfile(data); err != nil {
+			panic(err)
+		}
+		if *dedup {
+			panic("Dedup and encryption don't mix, the keys of a blob would share its data key")
+		}
+		if shards != 0 {
+			panic("Erasure coding and encryption don't mix")
+		}
+		for _, p := range policies {
+			if p.data != 0 {
+				panic("Erasure coding and encryption don't mix")
+			}
+		}
+	} else if command == "rewrap" {
+		panic("Need a key file to rewrap with")
+	}
+	if *compress != "none" && !codecs[*compress] {
+		panic(fmt.Sprintf("Unknown codec %s", *compress))
+	}
+	if *quorum < 0 {
+		panic("Quorum can't be negative")
+	}
+	if *layout < 0 || *layout > maxLayout {
+		panic(fmt.Sprintf("Layout must be 0 to %d", maxLayout))
+	}
+
+	if !*md5sum || *checksum == "none" {
+		*checksum = ""
+	} else if _, ok := checksums[*checksum]; !ok {
+		panic(fmt.Sprintf("Unknown checksum %s", *checksum))
+	}
+	if *dedup && *checksum != "sha256" && *checksum != "blake3" {
+		panic("Dedup needs a checksum without collisions, sha256 or blake3")
 	}
 
 	db, err := leveldb.OpenFile(*pdb, nil)
@@ -111,21 +236,48 @@ func main() {
 	fmt.Printf("volume servers: %s\n", volumes)
 	a := App{db: db,
 		lock:       make(map[string]struct{}),
-		uploadids:  make(map[string]bool),
+		uploadids:  make(map[string]http.Header),
+		readonly:   make(map[string]bool),
 		volumes:    volumes,
+		policies:   policies,
+		data:       shards,
+		parity:     parity,
+		layout:     *layout,
+		quorum:     *quorum,
+		verify:     *verify,
+		compress:   *compress,
+		keys:       keys,
+		keyid:      keyid,
+		spooldir:   *spooldir,
 		fallback:   *fallback,
 		replicas:   *replicas,
 		subvolumes: *subvolumes,
 		protect:    *protect,
-		md5sum:     *md5sum,
+		versioned:  *versioned,
+		dedup:      *dedup,
+		retention:  *retention,
+		checksum:   *checksum,
 		voltimeout: *voltimeout,
 	}
 
+	a.LoadReadOnly()
+
 	if command == "server" {
+		go a.Reaper(*reapinterval)
+		go a.Drainer()
+		go a.Repairer(*repairinterval)
+		go a.Cleaner(*repairinterval)
+		go a.Refiller(*repairinterval)
 		http.ListenAndServe(fmt.Sprintf(":%d", *port), &a)
 	} else if command == "rebuild" {
 		a.Rebuild()
 	} else if command == "rebalance" {
 		a.Rebalance()
+	} else if command == "migrate-index" {
+		a.MigrateIndex()
+	} else if command == "migrate-layout" {
+		a.MigrateLayout()
+	} else if command == "rewrap" {
+		a.Rewrap()
 	}
 }
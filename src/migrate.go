@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// rewrites every record that isn't in the current format, in place
+func (a *App) MigrateIndex() {
+	fmt.Println("migrating index to record version", recordVersion)
+
+	batch := new(leveldb.Batch)
+	flush := func() {
+		if err := a.db.Write(batch, nil); err != nil {
+			panic(fmt.Sprintf("migrate write failed: %s", err))
+		}
+		batch.Reset()
+	}
+
+	migrated, total := 0, 0
+	iter := a.db.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		if internal_key(iter.Key()) {
+			// never written in the old format
+			continue
+		}
+		total++
+		if record_version(iter.Value()) == recordVersion {
+			continue
+		}
+		// the batch copies the key and value
+		batch.Put(iter.Key(), fromRecord(toRecord(iter.Value())))
+		migrated++
+		if batch.Len() >= 10000 {
+			flush()
+		}
+	}
+	if err := iter.Error(); err != nil {
+		panic(fmt.Sprintf("migrate iterate failed: %s", err))
+	}
+	flush()
+
+	fmt.Printf("migrated %d of %d records\n", migrated, total)
+}
+
+// moves the values on the volumes to the -layout, and the records with them
+// the names of the files and shards don't change, just the directories
+func (a *App) MigrateLayout() {
+	fmt.Println("migrating values to layout", a.layout)
+
+	var wg sync.WaitGroup
+	var mlock sync.Mutex
+	migrated, failed := 0, 0
+	keys := make(chan []byte, 20000)
+
+	for i := 0; i < 16; i++ {
+		go func() {
+			for key := range keys {
+				ok := a.migrateLayout(key)
+				mlock.Lock()
+				if ok {
+					migrated++
+				} else {
+					failed++
+				}
+				mlock.Unlock()
+				wg.Done()
+			}
+		}()
+	}
+
+	iter := a.db.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		key := append([]byte{}, iter.Key()...)
+		rec := toRecord(iter.Value())
+		if _, ok := a.rebalanceRequest(key, rec); !ok || rec.layout == a.layout {
+			continue
+		}
+		wg.Add(1)
+		keys <- key
+	}
+	close(keys)
+	wg.Wait()
+
+	fmt.Printf("migrated %d values, %d failed\n", migrated, failed)
+}
+
+func (a *App) migrateLayout(key []byte) bool {
+	rec := a.GetRecord(key)
+	req, ok := a.rebalanceRequest(key, rec)
+	if !ok {
+		return true
+	}
+
+	// the paths of each file in both layouts, on the volume it's on
+	// many keys have the same path in both, they stay where they are
+	var froms, tos []string
+	for i, volume := range rec.rvolumes {
+		name := req.blob
+		if rec.data != 0 {
+			name = blob2shard(req.blob, rec, i)
+		}
+		from := layout2path(name, rec.layout)
+		to := layout2path(name, a.layout)
+		if volume != "" && from != to {
+			froms = append(froms, fmt.Sprintf("http://%s%s", volume, from))
+			tos = append(tos, fmt.Sprintf("http://%s%s", volume, to))
+		}
+	}
+
+	// copy, then point the record at the copies, then delete
+	for i, from := range froms {
+		to := tos[i]
+		ss, err := remote_get(from)
+		if err != nil {
+			fmt.Println("migrate get error", err, from)
+			return false
+		}
+		if err := remote_put(to, int64(len(ss)), bytes.NewReader([]byte(ss))); err != nil {
+			fmt.Println("migrate put error", err, to)
+			return false
+		}
+	}
+	nrec := rec
+	nrec.layout = a.layout
+	if !a.PutRecord(key, nrec) {
+		fmt.Println("migrate put db error", string(key))
+		return false
+	}
+	for _, from := range froms {
+		if err := remote_delete(from); err != nil {
+			fmt.Println("migrate delete error", err, from)
+		}
+	}
+	return true
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"strings"
 	"sync"
@@ -8,13 +9,18 @@ import (
 )
 
 type RebalanceRequest struct {
-	key      []byte
+	key      []byte // in the database
+	blob     []byte // on the volumes
 	volumes  []string
 	kvolumes []string
 }
 
 func rebalance(a *App, req RebalanceRequest) bool {
-	kp := key2path(req.key)
+	rec := a.GetRecord(req.key)
+	if rec.data != 0 {
+		return rebalance_shards(a, req, rec)
+	}
+	kp := layout2path(req.blob, rec.layout)
 
 	// find the volumes that are real
 	rvolumes := make([]string, 0)
@@ -84,8 +90,15 @@ func rebalance(a *App, req RebalanceRequest) bool {
 		return false
 	}
 
-	// update db
-	if !a.PutRecord(req.key, Record{req.kvolumes, NO, ""}) {
+	// update db, keeping everything but the volumes
+	rec = a.GetRecord(req.key)
+	if rec.deleted == HARD {
+		fmt.Println("rebalance record vanished", string(req.key))
+		return false
+	}
+	rec.rvolumes = req.kvolumes
+	rec.missing = nil
+	if !a.PutRecord(req.key, rec) {
 		fmt.Println("rebalance put db error", err)
 		return false
 	}
@@ -114,6 +127,31 @@ func rebalance(a *App, req RebalanceRequest) bool {
 	return true
 }
 
+// what moving the key in the database to where it belongs looks like
+// false if there is nothing to move
+func (a *App) rebalanceRequest(key []byte, rec Record) (RebalanceRequest, bool) {
+	if internal_key(key) && !bytes.HasPrefix(key, versionPrefix) && !bytes.HasPrefix(key, blobPrefix) {
+		return RebalanceRequest{}, false
+	}
+	blob := rec2blob(key, rec)
+	if vkey, _, ok := key2version(key); ok {
+		if len(rec.rvolumes) == 0 {
+			// delete markers have nothing to move
+			return RebalanceRequest{}, false
+		}
+		blob = rec2blob(vkey, rec)
+	} else if is_versioned(rec) {
+		// the versions are rebalanced on their own
+		return RebalanceRequest{}, false
+	}
+	kvolumes := a.KeyVolumes(blob, rec)
+	return RebalanceRequest{
+		key:      key,
+		blob:     blob,
+		volumes:  rec.rvolumes,
+		kvolumes: kvolumes}, true
+}
+
 func (a *App) Rebalance() {
 	fmt.Println("rebalancing to", a.volumes)
 
@@ -134,13 +172,12 @@ func (a *App) Rebalance() {
 	for iter.Next() {
 		key := make([]byte, len(iter.Key()))
 		copy(key, iter.Key())
-		rec := toRecord(iter.Value())
-		kvolumes := key2volume(key, a.volumes, a.replicas, a.subvolumes)
+		req, ok := a.rebalanceRequest(key, toRecord(iter.Value()))
+		if !ok {
+			continue
+		}
 		wg.Add(1)
-		reqs <- RebalanceRequest{
-			key:      key,
-			volumes:  rec.rvolumes,
-			kvolumes: kvolumes}
+		reqs <- req
 	}
 	close(reqs)
 
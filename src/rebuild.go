@@ -1,25 +1,30 @@
 package main
 
 import (
-	"encoding/base64"
+	"bufio"
+	"bytes"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 type File struct {
 	Name  string
 	Type  string
 	Mtime string
+	Size  int64
 }
 
 type RebuildRequest struct {
-	vol string
-	url string
+	vol  string
+	path string
 }
 
 func get_files(url string) []File {
@@ -34,28 +39,104 @@ func get_files(url string) []File {
 	return files
 }
 
-func rebuild(a *App, vol string, name string) bool {
-	key, err := base64.StdEncoding.DecodeString(name)
-	if err != nil {
-		fmt.Println("base64 decode error", err)
+// the path is where the file is on the volume, which says what key it's for
+func rebuild(a *App, vol string, path string, f File) bool {
+	blob, layout, ok := path2key(path)
+	if !ok {
+		fmt.Println("not a value", vol, path)
 		return false
 	}
 
-	kvolumes := key2volume(key, a.volumes, a.replicas, a.subvolumes)
+	// shards of an erasure coded value have the coding in the name
+	blob, shard, index := shard2blob(blob)
 
-	if !a.LockKey(key) {
-		fmt.Println("lockKey issue", key)
-		return false
+	p := a.Policy(blob)
+	kvolumes := key2volume(blob, a.volumes, p.replicas, p.subvolumes)
+
+	// encrypted values have the cipher in the name, and the data key at the start
+	// compressed values have the codec in the name
+	// links to shared blobs have the hash in the name
+	// versions of a key are stored with the version in the name
+	// without -versioned, only the newest one is the value of the key
+	key, encrypted := blob2cipher(blob)
+	key, codec := blob2codec(key)
+	key, ref := blob2link(key)
+	version := ""
+	if !bytes.HasPrefix(key, blobPrefix) {
+		key, version = blob2key(key)
+	}
+	if version != "" && a.versioned {
+		key = version2key(key, version)
+	}
+
+	// the other replicas or shards of the key can be on other volumes at the same time
+	for !a.LockKey(key) {
+		time.Sleep(10 * time.Millisecond)
 	}
 	defer a.UnlockKey(key)
 
 	data, err := a.db.Get(key, nil)
+	found := err != leveldb.ErrNotFound
 	var rec Record
-	if err != leveldb.ErrNotFound {
+	if found {
 		rec = toRecord(data)
+	}
+	if found && rec.version > version {
+		// left behind by an overwrite
+		fmt.Println("old value", string(blob))
+		return true
+	} else if found && rec.version == version && index != -1 {
+		if index < len(rec.rvolumes) {
+			rec.rvolumes[index] = vol
+		}
+	} else if found && rec.version == version {
 		rec.rvolumes = append(rec.rvolumes, vol)
 	} else {
-		rec = Record{[]string{vol}, NO, ""}
+		rec = Record{rvolumes: []string{vol}, deleted: NO, size: f.Size, version: version, layout: layout}
+		// nginx lists the mtime of the file, which is close to when it was written
+		if mtime, err := http.ParseTime(f.Mtime); err == nil {
+			rec.mtime = mtime.Unix()
+		}
+		if codec != "" {
+			// the size in the listing is compressed, the real one isn't known without reading it
+			rec.codec, rec.size = codec, 0
+		}
+		if encrypted {
+			remote := fmt.Sprintf("http://%s%s", vol, path)
+			body, err := remote_open(remote)
+			if err != nil {
+				fmt.Println("encryption header error", err, remote)
+				return false
+			}
+			rec.keyid, rec.wrapped, err = read_encrypt_header(bufio.NewReader(body))
+			body.Close()
+			if err != nil {
+				fmt.Println("encryption header error", err, remote)
+				return false
+			}
+			rec.size = 0
+		}
+		if kv := strings.SplitN(ref, ":", 2); len(kv) == 2 {
+			rec.dedup = true
+			rec.hashalg, rec.hash = kv[0], kv[1]
+		}
+		if index != -1 {
+			// the size in the listing is of the shard
+			rec.data, rec.parity, rec.size = shard.data, shard.parity, shard.size
+			rec.rvolumes = make([]string, rec.data+rec.parity)
+			rec.rvolumes[index] = vol
+		}
+	}
+
+	if index != -1 {
+		// the order of the shards is the order of the volumes
+		rec.deleted = NO
+		if !a.PutRecord(key, rec) {
+			fmt.Println("put error", string(key))
+			return false
+		}
+		fmt.Println(string(blob), index, rec.rvolumes)
+		return true
 	}
 
 	// sort by order in kvolumes (sorry it's n^2 but n is small)
@@ -81,12 +162,14 @@ func rebuild(a *App, vol string, name string) bool {
 		}
 	}
 
-	if !a.PutRecord(key, Record{pvalues, NO, ""}) {
+	rec.rvolumes = pvalues
+	rec.deleted = NO
+	if !a.PutRecord(key, rec) {
 		fmt.Println("put error", err)
 		return false
 	}
 
-	fmt.Println(string(key), pvalues)
+	fmt.Println(string(blob), pvalues)
 	return true
 }
 
@@ -116,13 +199,22 @@ func (a *App) Rebuild() {
 	var wg sync.WaitGroup
 	reqs := make(chan RebuildRequest, 20000)
 
+	// the values are as deep as their layout, or deeper for the old one
+	var walk func(vol string, path string)
+	walk = func(vol string, path string) {
+		for _, f := range get_files(fmt.Sprintf("http://%s%s/", vol, path)) {
+			if f.Type == "directory" {
+				walk(vol, path+"/"+f.Name)
+			} else {
+				rebuild(a, vol, path+"/"+f.Name, f)
+			}
+		}
+	}
+
 	for i := 0; i < 128; i++ {
 		go func() {
 			for req := range reqs {
-				files := get_files(req.url)
-				for _, f := range files {
-					rebuild(a, req.vol, f.Name)
-				}
+				walk(req.vol, req.path)
 				wg.Done()
 			}
 		}()
@@ -131,18 +223,14 @@ func (a *App) Rebuild() {
 	parse_volume := func(tvol string) {
 		for _, i := range get_files(fmt.Sprintf("http://%s/", tvol)) {
 			if valid(i) {
-				for _, j := range get_files(fmt.Sprintf("http://%s/%s/", tvol, i.Name)) {
-					if valid(j) {
-						wg.Add(1)
-						url := fmt.Sprintf("http://%s/%s/%s/", tvol, i.Name, j.Name)
-						reqs <- RebuildRequest{tvol, url}
-					}
-				}
+				wg.Add(1)
+				reqs <- RebuildRequest{tvol, "/" + i.Name}
 			}
 		}
 	}
 
-	for _, vol := range a.volumes {
+	for _, v := range a.volumes {
+		vol := v.name
 		has_subvolumes := false
 		for _, f := range get_files(fmt.Sprintf("http://%s/", vol)) {
 			if len(f.Name) == 4 && strings.HasPrefix(f.Name, "sv") && f.Type == "directory" {
@@ -157,4 +245,40 @@ func (a *App) Rebuild() {
 
 	close(reqs)
 	wg.Wait()
+
+	// point the versioned keys at their newest version
+	// delete markers aren't on the volumes, so they are lost
+	// a value from before the key was versioned has no version in its name, it's kept as the first one
+	viter := a.db.NewIterator(util.BytesPrefix(versionPrefix), nil)
+	defer viter.Release()
+	for viter.Next() {
+		key, version, _ := key2version(viter.Key())
+		if old, ok := unversioned2version(a.GetRecord(key)); ok {
+			a.PutRecord(version2key(key, old.version), old)
+		}
+		a.PutRecord(key, Record{rvolumes: []string{}, deleted: NO, version: version})
+	}
+
+	// count the links to the shared blobs, which have the size of the value
+	diter := a.db.NewIterator(nil, nil)
+	defer diter.Release()
+	for diter.Next() {
+		if internal_key(diter.Key()) && !bytes.HasPrefix(diter.Key(), versionPrefix) {
+			continue
+		}
+		rec := toRecord(diter.Value())
+		if !rec.dedup {
+			continue
+		}
+		bkey := rec2ref(rec)
+		brec := a.GetRecord(bkey)
+		if brec.deleted == HARD {
+			fmt.Println("missing blob", string(diter.Key()))
+			continue
+		}
+		brec.refs++
+		rec.size = brec.size
+		a.PutRecord(bkey, brec)
+		a.PutRecord(diter.Key(), rec)
+	}
 }
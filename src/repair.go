@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// *** Repair ***
+
+// writes the replicas that quorum writes left out, once their volumes are back
+func (a *App) Repairer(interval time.Duration) {
+	for range time.Tick(interval) {
+		a.reap(repairPrefix, time.Now().Unix(), a.repair)
+	}
+}
+
+// copies the value of the key from a replica that has it to the ones it's missing from
+// a missing volume that filled up in the meantime is swapped for the next best one
+func (a *App) repair(key []byte, t int64) bool {
+	rec := a.GetRecord(key)
+	if rec.deleted == HARD || len(rec.missing) == 0 {
+		// deleted or repaired since, by a rebalance or a new value
+		return true
+	}
+	if len(rec.rvolumes) == 0 {
+		fmt.Println("repair impossible, no replicas of", string(key))
+		return false
+	}
+	blob := rec2blob(key, rec)
+	if vkey, _, ok := key2version(key); ok {
+		blob = rec2blob(vkey, rec)
+	}
+	kvolumes := a.KeyVolumes(blob, Record{})
+	targets := repair_targets(rec.rvolumes, kvolumes, len(rec.missing))
+	size := rec.size
+	if rec.dedup {
+		// the key only has a link
+		size = 0
+	} else if rec.codec != "" || rec.keyid != "" {
+		// the size on the volumes isn't in the record
+		size = -1
+	}
+
+	var body io.ReadCloser
+	var err error
+	for _, v := range rec.rvolumes {
+		remote_from := fmt.Sprintf("http://%s%s", v, layout2path(blob, rec.layout))
+		if body, err = remote_open(remote_from); err == nil {
+			break
+		}
+		fmt.Println("repair get error", err, remote_from)
+	}
+	if err != nil {
+		return false
+	}
+	defer body.Close()
+
+	var remotes []string
+	for _, v := range targets {
+		remotes = append(remotes, fmt.Sprintf("http://%s%s", v, layout2path(blob, rec.layout)))
+	}
+	// not enough volumes take writes for all of them
+	missing := rec.missing[len(targets):]
+	for i, err := range remote_put_all(remotes, size, body, len(remotes)) {
+		if err == errFull {
+			a.SetReadOnly(strings.Split(targets[i], "/")[0])
+		}
+		if err != nil {
+			fmt.Println("repair put error", err, remotes[i])
+			missing = append(missing, targets[i])
+		} else {
+			rec.rvolumes = append(rec.rvolumes, targets[i])
+		}
+	}
+
+	// the key is locked, so the record is the same
+	rec.rvolumes = order_volumes(rec.rvolumes, kvolumes)
+	rec.missing = missing
+	if !a.PutRecord(key, rec) {
+		fmt.Println("repair put db error", string(key))
+		return false
+	}
+	if len(missing) == 0 {
+		fmt.Println("repaired", string(key))
+	}
+	return len(missing) == 0
+}
@@ -1,17 +1,22 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
-	"crypto/md5"
+	crand "crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"hash"
 	"io"
+	"io/ioutil"
 	"log"
 	"math/rand"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/syndtr/goleveldb/leveldb/util"
@@ -34,8 +39,8 @@ func (a *App) QueryHandler(key []byte, w http.ResponseWriter, r *http.Request) {
 
 		ret := "<ListBucketResult>"
 		for iter.Next() {
-			rec := toRecord(iter.Value())
-			if rec.deleted != NO {
+			rec := a.Latest(iter.Key(), toRecord(iter.Value()))
+			if rec.deleted != NO || expired(rec) {
 				continue
 			}
 			ret += "<Contents><Key>" + string(iter.Key()[len(key):]) + "</Key></Contents>"
@@ -49,6 +54,9 @@ func (a *App) QueryHandler(key []byte, w http.ResponseWriter, r *http.Request) {
 	// operation is first query parameter (e.g. ?list&limit=10)
 	operation := strings.Split(r.URL.RawQuery, "&")[0]
 	switch operation {
+	case "versions":
+		a.ListVersions(key, w)
+		return
 	case "list", "unlinked":
 		start := r.URL.Query().Get("start")
 		limit := 0
@@ -62,6 +70,18 @@ func (a *App) QueryHandler(key []byte, w http.ResponseWriter, r *http.Request) {
 			limit = nlimit
 		}
 
+		// only the keys unlinked at least this long ago
+		older := time.Duration(0)
+		if qolder := r.URL.Query().Get("older"); qolder != "" {
+			dolder, err := time.ParseDuration(qolder)
+			if err != nil {
+				w.WriteHeader(400)
+				return
+			}
+			older = dolder
+		}
+		before := time.Now().Add(-older).Unix()
+
 		slice := util.BytesPrefix(key)
 		if start != "" {
 			slice.Start = []byte(start)
@@ -71,9 +91,10 @@ func (a *App) QueryHandler(key []byte, w http.ResponseWriter, r *http.Request) {
 		keys := make([]string, 0)
 		next := ""
 		for iter.Next() {
-			rec := toRecord(iter.Value())
-			if (rec.deleted != NO && operation == "list") ||
-				(rec.deleted != SOFT && operation == "unlinked") {
+			rec := a.Latest(iter.Key(), toRecord(iter.Value()))
+			if ((rec.deleted != NO || expired(rec)) && operation == "list") ||
+				(rec.deleted != SOFT && operation == "unlinked") ||
+				(older != 0 && rec.unlinked > before) {
 				continue
 			}
 			if len(keys) > 1000000 { // too large (need to specify limit)
@@ -101,35 +122,44 @@ func (a *App) QueryHandler(key []byte, w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (a *App) Delete(key []byte, unlink bool) int {
+func (a *App) Delete(key []byte, unlink bool, actor string) int {
 	// delete the key, first locally
 	rec := a.GetRecord(key)
 	if rec.deleted == HARD || (unlink && rec.deleted == SOFT) {
 		return 404
 	}
 
-	if !unlink && a.protect && rec.deleted == NO {
-		return 403
+	if !unlink && a.protect {
+		if rec.deleted == NO {
+			return 403
+		}
+		// and the unlink must be older than the retention
+		if rec.unlinked != 0 && time.Now().Unix() < rec.unlinked+int64(a.retention.Seconds()) {
+			return 403
+		}
 	}
 
-	// mark as deleted
-	if !a.PutRecord(key, Record{rec.rvolumes, SOFT, rec.hash}) {
+	if !unlink && (a.versioned || is_versioned(rec)) {
+		return a.DeleteMarker(key, rec)
+	}
+
+	// mark as deleted, the tombstone remembers when
+	if rec.deleted == NO {
+		rec.unlinked = time.Now().Unix()
+		rec.unlinkedby = actor
+		// even without -unlink-retention, so turning it on later purges this one too
+		if a.db.Put(time2key(unlinkedPrefix, rec.unlinked, key), []byte{}, nil) != nil {
+			return 500
+		}
+	}
+	rec.deleted = SOFT
+	if !a.PutRecord(key, rec) {
 		return 500
 	}
 
 	if !unlink {
 		// then remotely, if this is not an unlink
-		delete_error := false
-		for _, volume := range rec.rvolumes {
-			remote := fmt.Sprintf("http://%s%s", volume, key2path(key))
-			if remote_delete(remote) != nil {
-				// if this fails, it's possible to get an orphan file
-				// but i'm not really sure what else to do?
-				delete_error = true
-			}
-		}
-
-		if delete_error {
+		if !a.DeleteValue(key, rec) {
 			return 500
 		}
 
@@ -141,43 +171,450 @@ func (a *App) Delete(key []byte, unlink bool) int {
 	return 204
 }
 
-func (a *App) WriteToReplicas(key []byte, value io.Reader, valuelen int64) int {
+// removes the value of a record from the volume servers
+func (a *App) DeleteValue(key []byte, rec Record) bool {
+	if rec.data != 0 {
+		return a.DeleteShards(rec2blob(key, rec), rec)
+	}
+	delete_error := false
+	for _, volume := range rec.rvolumes {
+		remote := fmt.Sprintf("http://%s%s", volume, layout2path(rec2blob(key, rec), rec.layout))
+		if remote_delete(remote) != nil {
+			// if this fails, it's possible to get an orphan file
+			// but i'm not really sure what else to do?
+			delete_error = true
+		}
+	}
+	for _, volume := range rec.missing {
+		// in case a failed write left something, the volume is probably down anyway
+		remote_delete(fmt.Sprintf("http://%s%s", volume, layout2path(rec2blob(key, rec), rec.layout)))
+	}
+	if delete_error {
+		return false
+	}
+
+	// the shared blob goes once the last link is gone
+	if rec.dedup {
+		return a.Unref(rec)
+	}
+	return true
+}
+
+// returns the status to fail a write with, or 0 if it can go ahead
+// the key must be locked, so nothing changes before the write
+func (a *App) CheckWrite(key []byte, header http.Header) int {
+	rec := a.GetLatest(key)
+	exists := rec.deleted == NO && !expired(rec)
+
+	// conditional writes, on the etag of the value
+	if inm := header.Get("If-None-Match"); inm != "" && exists && etag_match(inm, rec.hash) {
+		return 412
+	}
+	if im := header.Get("If-Match"); im != "" {
+		if !exists || !etag_match(im, rec.hash) {
+			return 412
+		}
+		return 0
+	}
+
+	if exists && !a.versioned && !is_versioned(a.GetRecord(key)) {
+		// Forbidden to overwrite, unless asked to or it makes a new version
+		return 403
+	}
+	return 0
+}
+
+// who is making the request, for the tombstones
+func request_actor(r *http.Request) string {
+	if actor := r.Header.Get("X-Mkv-Actor"); actor != "" {
+		return actor
+	}
+	return r.RemoteAddr
+}
+
+// a temporary file in -spooldir, which is gone once it's closed
+func (a *App) SpoolFile() (*os.File, error) {
+	f, err := ioutil.TempFile(a.spooldir, "mkv-spool-")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(f.Name())
+	return f, nil
+}
+
+// reads the body into a temporary file
+func (a *App) Spool(body io.Reader) (*os.File, int64, error) {
+	f, err := a.SpoolFile()
+	if err != nil {
+		return nil, 0, err
+	}
+	n, err := io.Copy(f, body)
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, n, nil
+}
+
+// valuelen is -1 if it's not known until the value ends
+func (a *App) WriteToReplicas(key []byte, value io.Reader, valuelen int64, header http.Header) int {
+	meta, err := header2meta(header)
+	if err != nil {
+		log.Println(err)
+		return 400
+	}
+	expected, err := header2checksums(header)
+	if err != nil {
+		log.Println(err)
+		return 400
+	}
+	expires, err := header2expires(header, time.Now())
+	if err != nil {
+		log.Println(err)
+		return 400
+	}
+
+	prev := a.GetRecord(key)
+	rec := Record{deleted: SOFT, layout: a.layout}
+	versioned := a.versioned || is_versioned(prev)
+	overwrite := !versioned && prev.deleted == NO
+	if versioned || overwrite {
+		// the new value goes next to the old one, which stays readable until this one is done
+		rec.version = new_version()
+	}
+
+	// hash what we stored, and whatever the client sent checksums for
+	hashes := make(map[string]hash.Hash)
+	if a.checksum != "" {
+		hashes[a.checksum] = checksums[a.checksum]()
+	}
+	for alg := range expected {
+		if _, ok := hashes[alg]; !ok {
+			hashes[alg] = checksums[alg]()
+		}
+	}
+	// and count it, a chunked PUT says how big it is at the end
+	var counted counter
+	writers := []io.Writer{&counted}
+	for _, h := range hashes {
+		writers = append(writers, h)
+	}
+	body := io.TeeReader(value, io.MultiWriter(writers...))
+
+	// the value streams through to the volumes, unless it has to be read before it's written
+	// then it goes to a file, so big values aren't in memory
+	size := valuelen
+	policy := a.Policy(key)
+	var spool *os.File
+	if a.dedup || policy.data != 0 {
+		if spool, size, err = a.Spool(body); err != nil {
+			fmt.Println("spool error", err)
+			return 500
+		}
+		defer spool.Close()
+	}
+	if a.dedup {
+		// where the value goes depends on its hash
+		// and the key only gets an empty link to it
+		rec.dedup = true
+		rec.hash = hex.EncodeToString(hashes[a.checksum].Sum(nil))
+		rec.hashalg = a.checksum
+	}
+	putlen := size
+	if a.dedup {
+		putlen = 0
+	}
+	if policy.data != 0 {
+		// the shards are made from the whole value
+		rec.data, rec.parity, rec.size = policy.data, policy.parity, size
+	}
+
+	// compressed, then encrypted as it's written, so how much is written isn't known until the end
+	// hashes are of the value, not what's on the volumes
+	stream := body
+	var stored counter
+	if policy.compress != "" && policy.data == 0 && !a.dedup {
+		rec.codec = policy.compress
+		cr := compress_reader(stream, rec.codec)
+		defer cr.Close()
+		stream = cr
+	}
+	if a.keys != nil {
+		dk := make([]byte, 32)
+		if _, err := crand.Read(dk); err != nil {
+			return 500
+		}
+		if rec.wrapped, err = wrap_key(a.keys[a.keyid], dk); err != nil {
+			fmt.Println("wrap key error", err)
+			return 500
+		}
+		rec.keyid = a.keyid
+		er := encrypt_reader(stream, dk, encrypt_header(rec.keyid, rec.wrapped))
+		defer er.Close()
+		stream = er
+	}
+	if stream != body {
+		stream = io.TeeReader(stream, &stored)
+		putlen = -1
+	}
+
 	// we don't have the key, compute the remote URL
-	kvolumes := key2volume(key, a.volumes, a.replicas, a.subvolumes)
+	blob := rec2blob(key, rec)
+	place := Record{data: rec.data, parity: rec.parity}
+	kvolumes := a.KeyVolumes(blob, place)
+	if len(kvolumes) < policy.count() {
+		fmt.Println("not enough volumes take writes")
+		return 507
+	}
+	rec.rvolumes = kvolumes
+	rkey := key
+	if versioned {
+		rkey = version2key(key, rec.version)
+	}
+
+	// a failed write leaves nothing behind, the record goes back to how it was
+	// and the files that were written are deleted again
+	var files []string
+	done := false
+	defer func() {
+		if done {
+			return
+		}
+		ok := true
+		if versioned || prev.deleted == HARD {
+			ok = a.db.Delete(rkey, nil) == nil
+		} else if !overwrite {
+			ok = a.PutRecord(key, prev)
+		}
+		if !ok {
+			// the files stay where the record says they are
+			fmt.Println("rollback db error", string(key))
+			return
+		}
+		listed := make(map[string]bool)
+		for _, remote := range files {
+			listed[remote] = true
+		}
+		for _, volume := range rec.missing {
+			// where a quorum write failed, unless it's listed already
+			if remote := fmt.Sprintf("http://%s%s", volume, layout2path(blob, rec.layout)); !listed[remote] {
+				files = append(files, remote)
+			}
+		}
+		a.DeleteFiles(rkey, files)
+	}()
 
 	// push to leveldb initially as deleted, and without a hash since we don't have it yet
-	if !a.PutRecord(key, Record{kvolumes, SOFT, ""}) {
+	// an overwrite leaves the old record alone
+	if (versioned || !overwrite) && !a.PutRecord(rkey, rec) {
 		return 500
 	}
 
-	// write to each replica
-	var buf bytes.Buffer
-	body := io.TeeReader(value, &buf)
-	for i := 0; i < len(kvolumes); i++ {
-		if i != 0 {
-			// if we have already read the contents into the TeeReader
-			body = bytes.NewReader(buf.Bytes())
+	if rec.data != 0 {
+		// a full volume is made read-only, and the shards are placed again
+		for {
+			written, err := a.WriteShards(blob, rec, spool)
+			if err == nil {
+				files = written
+				break
+			}
+			a.DeleteFiles(rkey, written)
+			if err != errFull {
+				return 500
+			}
+			if rec.rvolumes = a.KeyVolumes(blob, place); len(rec.rvolumes) < policy.count() {
+				fmt.Println("not enough volumes take writes")
+				return 507
+			}
 		}
-		remote := fmt.Sprintf("http://%s%s", kvolumes[i], key2path(key))
-		if remote_put(remote, valuelen, body) != nil {
-			// we assume the remote wrote nothing if it failed
-			fmt.Printf("replica %d write failed: %s\n", i, remote)
+		kvolumes = rec.rvolumes
+	} else {
+		// write to all the replicas at once
+		// a full volume is made read-only, and the next best volume takes its place
+		// the body is read once, so that one is left to the repairer with a quorum
+		// without one the PUT fails with 507, and the client can try again
+		// with a quorum, a volume that fails is left out, and repaired later
+		written := make(map[string]bool)
+		failed := make(map[string]bool)
+		read := false
+		full := false
+		for {
+			var todo, remotes []string
+			for _, volume := range kvolumes {
+				if !written[volume] && !failed[volume] {
+					todo = append(todo, volume)
+					remotes = append(remotes, fmt.Sprintf("http://%s%s", volume, layout2path(blob, rec.layout)))
+				}
+			}
+			if len(todo) == 0 {
+				break
+			}
+			src := stream
+			if a.dedup {
+				// the links are empty
+				src = bytes.NewReader(nil)
+			} else if read {
+				break
+			}
+			errs := remote_put_all(remotes, putlen, src, a.Quorum(policy)-len(written))
+			if !read {
+				// the rest of the value, in case the writes stopped early
+				if _, err := io.Copy(ioutil.Discard, stream); err != nil {
+					return 500
+				}
+				read = true
+			}
+			placed := true
+			for i, err := range errs {
+				if err == errFull {
+					fmt.Printf("replica is full: %s\n", remotes[i])
+					a.SetReadOnly(strings.Split(todo[i], "/")[0])
+					full, placed = true, false
+				} else if err != nil {
+					// it can have written part of the value, and deleting nothing is fine
+					fmt.Printf("replica write failed: %s\n", remotes[i])
+					failed[todo[i]] = true
+					files = append(files, remotes[i])
+				} else {
+					written[todo[i]] = true
+					files = append(files, remotes[i])
+				}
+			}
+			if !placed {
+				if kvolumes = a.KeyVolumes(blob, place); len(kvolumes) < policy.count() {
+					fmt.Println("not enough volumes take writes")
+					return 507
+				}
+			}
+		}
+		// the replicas that count, and the ones the repairer writes
+		var rvolumes []string
+		for _, volume := range kvolumes {
+			if written[volume] {
+				rvolumes = append(rvolumes, volume)
+			} else {
+				rec.missing = append(rec.missing, volume)
+			}
+		}
+		if len(rvolumes) < a.Quorum(policy) {
+			fmt.Printf("write quorum not reached: %s\n", string(key))
+			if full {
+				return 507
+			}
 			return 500
 		}
+
+		// the ones written before the placement moved
+		files = nil
+		for _, volume := range rvolumes {
+			files = append(files, fmt.Sprintf("http://%s%s", volume, layout2path(blob, rec.layout)))
+			delete(written, volume)
+		}
+		var moved []string
+		for volume := range written {
+			moved = append(moved, fmt.Sprintf("http://%s%s", volume, layout2path(blob, rec.layout)))
+		}
+		for _, volume := range rec.missing {
+			delete(failed, volume)
+		}
+		for volume := range failed {
+			// not missing anymore either, a failed write can leave part of the value
+			moved = append(moved, fmt.Sprintf("http://%s%s", volume, layout2path(blob, rec.layout)))
+		}
+		a.DeleteFiles(rkey, moved)
+		kvolumes = rvolumes
+	}
+
+	size = int64(counted)
+
+	// the record is still deleted, so a bad value is never visible
+	for alg, sum := range expected {
+		if !bytes.Equal(hashes[alg].Sum(nil), sum) {
+			fmt.Printf("%s checksum mismatch: %s\n", alg, string(key))
+			return 400
+		}
+	}
+
+	var hexsum = ""
+	if a.checksum != "" {
+		hexsum = hex.EncodeToString(hashes[a.checksum].Sum(nil))
+	}
+
+	// read back what the volumes stored, before the value is visible
+	if a.verify {
+		vsize, vsum := size, hexsum
+		if rec.dedup {
+			// the key only has links, Ref checks the blob
+			vsize, vsum = 0, ""
+		} else if rec.data != 0 {
+			// the shards have no checksums of their own
+			vsize, vsum = (size+int64(rec.data)-1)/int64(rec.data), ""
+		} else if rec.codec != "" || rec.keyid != "" {
+			vsize, vsum = int64(stored), ""
+		}
+		for i, err := range remote_verify_all(files, vsize, a.checksum, vsum) {
+			if err != nil {
+				fmt.Println("verify error", err, files[i])
+				return 500
+			}
+		}
 	}
 
-	var hash = ""
-	if a.md5sum {
-		// compute the hash of the value
-		hash = fmt.Sprintf("%x", md5.Sum(buf.Bytes()))
+	if a.dedup && !a.Ref(rec, spool, size) {
+		return 500
 	}
 
 	// push to leveldb as existing
 	// note that the key is locked, so nobody wrote to the leveldb
-	if !a.PutRecord(key, Record{kvolumes, NO, hash}) {
+	rec = Record{rvolumes: kvolumes, deleted: NO, hash: hexsum, hashalg: a.checksum,
+		size: size, mtime: time.Now().Unix(), ctype: header.Get("Content-Type"), meta: meta,
+		version: rec.version, expires: expires, dedup: rec.dedup,
+		data: rec.data, parity: rec.parity, layout: rec.layout, missing: rec.missing,
+		codec: rec.codec, keyid: rec.keyid, wrapped: rec.wrapped}
+
+	// the reaper checks the record, so the index can be written first
+	if expires != 0 && a.db.Put(time2key(expiryPrefix, expires, key), []byte{}, nil) != nil {
+		return 500
+	}
+	if len(rec.missing) != 0 && a.db.Put(time2key(repairPrefix, time.Now().Unix(), rkey), []byte{}, nil) != nil {
 		return 500
 	}
 
+	if versioned {
+		if !a.PutVersion(key, rec) {
+			return 500
+		}
+	} else if !a.PutRecord(key, rec) {
+		return 500
+	}
+	done = true
+
+	if overwrite {
+		// nothing points at the old value anymore, the deletes that fail are retried
+		a.DeleteFiles(key, rec2remotes(key, prev))
+		if prev.dedup && !a.Unref(prev) {
+			fmt.Println("overwrite unref error", string(key))
+		}
+	}
+	if !versioned && prev.deleted == SOFT {
+		// nor at an unlinked one, but the new value can be in the same place
+		written := make(map[string]bool)
+		for _, remote := range rec2remotes(key, rec) {
+			written[remote] = true
+		}
+		var stale []string
+		for _, remote := range rec2remotes(key, prev) {
+			if !written[remote] {
+				stale = append(stale, remote)
+			}
+		}
+		a.DeleteFiles(key, stale)
+		// a write that never finished has no link to its blob
+		if prev.dedup && prev.unlinked != 0 && !a.Unref(prev) {
+			fmt.Println("unlinked unref error", string(key))
+		}
+	}
+
 	// 201, all good
 	return 201
 }
@@ -189,7 +626,7 @@ func (a *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	log.Println(r.Method, r.URL, r.ContentLength, r.Header["Range"])
 
 	// this is a list query
-	if len(r.URL.RawQuery) > 0 && r.Method == "GET" {
+	if len(r.URL.RawQuery) > 0 && r.Method == "GET" && r.URL.Query().Get("versionId") == "" {
 		a.QueryHandler(key, w, r)
 		return
 	}
@@ -206,13 +643,28 @@ func (a *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	switch r.Method {
 	case "GET", "HEAD":
-		rec := a.GetRecord(key)
+		// an overwritten key has a version too, which is only shown if the key is versioned
+		var rec Record
+		versioned := true
+		if version := r.URL.Query().Get("versionId"); version != "" {
+			rec = a.GetRecord(version2key(key, version))
+		} else {
+			rec = a.GetRecord(key)
+			versioned = is_versioned(rec)
+			rec = a.Latest(key, rec)
+		}
+		blob := rec2blob(key, rec)
 		var remote string
 		if len(rec.hash) != 0 {
 			// note that the hash is always of the whole file, not the content requested
-			w.Header().Set("Content-Md5", rec.hash)
+			checksum2header(rec.hashalg, rec.hash, w.Header())
+			w.Header().Set("ETag", `"`+rec.hash+`"`)
 		}
-		if rec.deleted == SOFT || rec.deleted == HARD {
+		if rec.deleted == SOFT || rec.deleted == HARD || expired(rec) {
+			if rec.unlinked != 0 {
+				w.Header().Set("X-Mkv-Unlinked", time.Unix(rec.unlinked, 0).UTC().Format(http.TimeFormat))
+				w.Header().Set("X-Mkv-Unlinked-By", rec.unlinkedby)
+			}
 			if a.fallback == "" {
 				w.Header().Set("Content-Length", "0")
 				w.WriteHeader(404)
@@ -221,7 +673,22 @@ func (a *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			// fall through to fallback
 			remote = fmt.Sprintf("http://%s%s", a.fallback, key)
 		} else {
-			kvolumes := key2volume(key, a.volumes, a.replicas, a.subvolumes)
+			if rec.mtime != 0 {
+				// the stats are in the index, no need to ask the volume servers
+				w.Header().Set("X-Mkv-Size", strconv.FormatInt(rec.size, 10))
+				w.Header().Set("Last-Modified", time.Unix(rec.mtime, 0).UTC().Format(http.TimeFormat))
+				if rec.ctype != "" {
+					w.Header().Set("Content-Type", rec.ctype)
+				}
+			}
+			meta2header(rec.meta, w.Header())
+			if versioned {
+				w.Header().Set("X-Mkv-Version-Id", rec.version)
+			}
+			if rec.expires != 0 {
+				w.Header().Set("X-Mkv-Expires", time.Unix(rec.expires, 0).UTC().Format(http.TimeFormat))
+			}
+			kvolumes := a.KeyVolumes(blob, rec)
 			if needs_rebalance(rec.rvolumes, kvolumes) {
 				w.Header().Set("Key-Balance", "unbalanced")
 				fmt.Println("on wrong volumes, needs rebalance")
@@ -230,10 +697,45 @@ func (a *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			}
 			w.Header().Set("Key-Volumes", strings.Join(rec.rvolumes, ","))
 
+			if r.Method == "HEAD" && rec.mtime != 0 && rec.size != 0 {
+				w.Header().Set("Content-Length", strconv.FormatInt(rec.size, 10))
+				w.WriteHeader(200)
+				return
+			}
+
+			// there's no one volume with the value to redirect to, so it's put together here
+			// streamed from the shards, without Range support
+			if rec.data != 0 {
+				shards, err := a.OpenShards(blob, rec)
+				if err != nil {
+					fmt.Println("shard read error", err, string(key))
+					w.Header().Set("Content-Length", "0")
+					w.WriteHeader(404)
+					return
+				}
+				defer close_shards(shards)
+				w.Header().Set("Content-Length", strconv.FormatInt(rec.size, 10))
+				w.WriteHeader(200)
+				if r.Method == "GET" {
+					if err := a.JoinShards(rec, shards, w); err != nil {
+						fmt.Println("shard join error", err, string(key))
+					}
+				}
+				return
+			}
+
+			// the value of a link is in the shared blob
+			rvolumes, layout := rec.rvolumes, rec.layout
+			if rec.dedup {
+				blob = rec2ref(rec)
+				brec := a.GetRecord(blob)
+				rvolumes, layout = brec.rvolumes, brec.layout
+			}
+
 			// check the volume servers in a random order
 			good := false
-			for _, vn := range rand.Perm(len(rec.rvolumes)) {
-				remote = fmt.Sprintf("http://%s%s", rec.rvolumes[vn], key2path(key))
+			for _, vn := range rand.Perm(len(rvolumes)) {
+				remote = fmt.Sprintf("http://%s%s", rvolumes[vn], layout2path(blob, layout))
 				found, _ := remote_head(remote, a.voltimeout)
 				if found {
 					good = true
@@ -246,6 +748,10 @@ func (a *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				w.WriteHeader(404)
 				return
 			}
+			if rec.codec != "" || rec.keyid != "" {
+				a.ServeEncoded(w, r, rec, remote)
+				return
+			}
 			// note: this can race and fail, but in that case the client will handle the retry
 		}
 		w.Header().Set("Location", remote)
@@ -253,17 +759,16 @@ func (a *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(302)
 	case "POST":
 		// check if we already have the key, and it's not deleted
-		rec := a.GetRecord(key)
-		if rec.deleted == NO {
-			// Forbidden to overwrite with POST
-			w.WriteHeader(403)
+		if status := a.CheckWrite(key, r.Header); status != 0 {
+			w.WriteHeader(status)
 			return
 		}
 
 		// this will handle multipart uploads in "S3"
 		if r.URL.RawQuery == "uploads" {
 			uploadid := uuid.New().String()
-			a.uploadids[uploadid] = true
+			// some headers of the initiate request apply to the finished value
+			a.uploadids[uploadid] = upload_header(r.Header)
 
 			// init multipart upload
 			w.WriteHeader(200)
@@ -280,7 +785,7 @@ func (a *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 			for _, subkey := range del.Keys {
 				fullkey := fmt.Sprintf("%s/%s", key, subkey)
-				status := a.Delete([]byte(fullkey), false)
+				status := a.Delete([]byte(fullkey), false, request_actor(r))
 				if status != 204 {
 					w.WriteHeader(status)
 					return
@@ -288,7 +793,8 @@ func (a *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			}
 			w.WriteHeader(204)
 		} else if uploadid := r.URL.Query().Get("uploadId"); uploadid != "" {
-			if a.uploadids[uploadid] != true {
+			header, ok := a.uploadids[uploadid]
+			if !ok {
 				w.WriteHeader(403)
 				return
 			}
@@ -319,29 +825,35 @@ func (a *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				fs = append(fs, f)
 			}
 
-			status := a.WriteToReplicas(key, io.MultiReader(fs...), sz)
+			status := a.WriteToReplicas(key, io.MultiReader(fs...), sz, header)
 			w.WriteHeader(status)
 			w.Write([]byte("<CompleteMultipartUploadResult></CompleteMultipartUploadResult>"))
 			return
 		}
 	case "PUT":
-		// no empty values
+		// no empty values, a chunked one is empty if it ends right away
 		if r.ContentLength == 0 {
 			w.WriteHeader(411)
 			return
 		}
+		if r.ContentLength < 0 {
+			br := bufio.NewReader(r.Body)
+			if _, err := br.Peek(1); err != nil {
+				w.WriteHeader(411)
+				return
+			}
+			r.Body = ioutil.NopCloser(br)
+		}
 
 		// check if we already have the key, and it's not deleted
-		rec := a.GetRecord(key)
-		if rec.deleted == NO {
-			// Forbidden to overwrite with PUT
-			w.WriteHeader(403)
+		if status := a.CheckWrite(key, r.Header); status != 0 {
+			w.WriteHeader(status)
 			return
 		}
 
 		if pn := r.URL.Query().Get("partNumber"); pn != "" {
 			uploadid := r.URL.Query().Get("uploadId")
-			if a.uploadids[uploadid] != true {
+			if _, ok := a.uploadids[uploadid]; !ok {
 				w.WriteHeader(403)
 				return
 			}
@@ -356,11 +868,18 @@ func (a *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			io.Copy(f, r.Body)
 			w.WriteHeader(200)
 		} else {
-			status := a.WriteToReplicas(key, r.Body, r.ContentLength)
+			status := a.WriteToReplicas(key, r.Body, r.ContentLength, r.Header)
+			if rec := a.GetRecord(key); status == 201 && is_versioned(rec) {
+				w.Header().Set("X-Mkv-Version-Id", rec.version)
+			}
 			w.WriteHeader(status)
 		}
 	case "DELETE", "UNLINK":
-		status := a.Delete(key, r.Method == "UNLINK")
+		if version := r.URL.Query().Get("versionId"); version != "" && r.Method == "DELETE" {
+			w.WriteHeader(a.DeleteVersion(key, version))
+			return
+		}
+		status := a.Delete(key, r.Method == "UNLINK", request_actor(r))
 		w.WriteHeader(status)
 	case "REBALANCE":
 		rec := a.GetRecord(key)
@@ -369,8 +888,17 @@ func (a *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		kvolumes := key2volume(key, a.volumes, a.replicas, a.subvolumes)
-		rbreq := RebalanceRequest{key: key, volumes: rec.rvolumes, kvolumes: kvolumes}
+		dbkey := key
+		if is_versioned(rec) {
+			// only the latest version
+			dbkey = version2key(key, rec.version)
+			rec = a.GetRecord(dbkey)
+		}
+		rbreq, ok := a.rebalanceRequest(dbkey, rec)
+		if !ok {
+			w.WriteHeader(404)
+			return
+		}
 		if !rebalance(a, rbreq) {
 			w.WriteHeader(400)
 			return
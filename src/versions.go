@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// *** Versioned Keys ***
+
+type VersionResponse struct {
+	VersionId string `json:"versionId"`
+	Deleted   bool   `json:"deleted"`
+	Size      int64  `json:"size"`
+	Mtime     int64  `json:"mtime"`
+	Latest    bool   `json:"latest"`
+}
+
+type VersionsResponse struct {
+	Versions []VersionResponse `json:"versions"`
+}
+
+// the versions of a key that were written, oldest first
+func (a *App) GetVersions(key []byte) []Record {
+	iter := a.db.NewIterator(util.BytesPrefix(version2key(key, "")), nil)
+	defer iter.Release()
+	recs := make([]Record, 0)
+	for iter.Next() {
+		rec := toRecord(iter.Value())
+		if rec.deleted == SOFT && len(rec.rvolumes) != 0 && rec.unlinked == 0 {
+			// a write that never finished
+			continue
+		}
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+// the record of the latest version, or the record itself if the key isn't versioned
+func (a *App) GetLatest(key []byte) Record {
+	return a.Latest(key, a.GetRecord(key))
+}
+
+// the same, from the record of the key
+func (a *App) Latest(key []byte, rec Record) Record {
+	if is_versioned(rec) && rec.deleted == NO {
+		return a.GetRecord(version2key(key, rec.version))
+	}
+	return rec
+}
+
+// writes a version and points the key at it
+func (a *App) PutVersion(key []byte, rec Record) bool {
+	batch := new(leveldb.Batch)
+	prev := a.GetRecord(key)
+	old, keep := unversioned2version(prev)
+	if keep {
+		// the value from before the key was versioned becomes its oldest version
+		batch.Put(version2key(key, old.version), fromRecord(old))
+	}
+	batch.Put(version2key(key, rec.version), fromRecord(rec))
+	batch.Put(key, fromRecord(Record{rvolumes: []string{}, deleted: rec.deleted, version: rec.version}))
+	if a.db.Write(batch, nil) != nil {
+		return false
+	}
+	if !keep && prev.deleted == SOFT && !is_versioned(prev) {
+		// a write that never finished, nothing points at it anymore
+		// and it has no link to a shared blob yet
+		a.DeleteFiles(key, rec2remotes(key, prev))
+	}
+	return true
+}
+
+// points the key at the newest version that is left
+func (a *App) RefreshLatest(key []byte) bool {
+	recs := a.GetVersions(key)
+	if len(recs) == 0 {
+		return a.db.Delete(key, nil) == nil
+	}
+	latest := recs[len(recs)-1]
+	return a.PutRecord(key, Record{rvolumes: []string{}, deleted: latest.deleted, version: latest.version})
+}
+
+// a DELETE on a versioned key keeps the history, and adds a delete marker
+func (a *App) DeleteMarker(key []byte, rec Record) int {
+	if rec.deleted == SOFT && a.GetRecord(version2key(key, rec.version)).deleted == SOFT {
+		// already deleted
+		return 404
+	}
+	marker := Record{rvolumes: []string{}, deleted: SOFT, version: new_version(), mtime: time.Now().Unix()}
+	if !a.PutVersion(key, marker) {
+		return 500
+	}
+	return 204
+}
+
+// removes a version for good, the only way data leaves a versioned key
+func (a *App) DeleteVersion(key []byte, version string) int {
+	latest := a.GetRecord(key)
+	rec := a.GetRecord(version2key(key, version))
+	if rec.deleted == HARD {
+		return 404
+	}
+
+	if a.protect && latest.deleted == NO && latest.version == version {
+		// the latest version must be deleted first
+		return 403
+	}
+
+	if !a.DeleteValue(key, rec) {
+		return 500
+	}
+
+	if a.db.Delete(version2key(key, version), nil) != nil {
+		return 500
+	}
+	if latest.version == version && !a.RefreshLatest(key) {
+		return 500
+	}
+	return 204
+}
+
+func (a *App) ListVersions(key []byte, w http.ResponseWriter) {
+	latest := a.GetRecord(key)
+	versions := make([]VersionResponse, 0)
+	for _, rec := range a.GetVersions(key) {
+		versions = append(versions, VersionResponse{
+			VersionId: rec.version,
+			Deleted:   rec.deleted != NO,
+			Size:      rec.size,
+			Mtime:     rec.mtime,
+			Latest:    rec.version == latest.version,
+		})
+	}
+	str, err := json.Marshal(VersionsResponse{Versions: versions})
+	if err != nil {
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(str)
+}
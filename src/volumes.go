@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// *** Volume State ***
+
+// the volumes that take new values
+func (a *App) writable() []Volume {
+	a.mlock.Lock()
+	defer a.mlock.Unlock()
+	var ret []Volume
+	for _, v := range a.volumes {
+		if v.state == ACTIVE && !a.readonly[v.name] {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
+// a volume that said it's full gets no new values until a write to it works again
+// the index keeps it that way across restarts
+func (a *App) SetReadOnly(volume string) {
+	a.mlock.Lock()
+	defer a.mlock.Unlock()
+	if !a.readonly[volume] {
+		fmt.Println("volume", volume, "is read-only now")
+		a.readonly[volume] = true
+		if err := a.db.Put(readonly2key(volume), []byte{}, nil); err != nil {
+			fmt.Println("read-only put error", err)
+		}
+	}
+}
+
+// the volumes that were full when the server stopped
+// the ones that left the topology since are forgotten
+func (a *App) LoadReadOnly() {
+	iter := a.db.NewIterator(util.BytesPrefix(readonlyPrefix), nil)
+	defer iter.Release()
+	for iter.Next() {
+		volume := string(iter.Key()[len(readonlyPrefix):])
+		known := false
+		for _, v := range a.volumes {
+			known = known || v.name == volume
+		}
+		if !known {
+			a.db.Delete(iter.Key(), nil)
+			continue
+		}
+		fmt.Println("volume", volume, "is read-only, it was full")
+		a.readonly[volume] = true
+	}
+}
+
+// a small write to each full volume, every interval, says if there's room on it again
+func (a *App) Refiller(interval time.Duration) {
+	probe := []byte("probe")
+	for range time.Tick(interval) {
+		a.mlock.Lock()
+		var full []string
+		for volume := range a.readonly {
+			full = append(full, volume)
+		}
+		a.mlock.Unlock()
+
+		for _, volume := range full {
+			remote := fmt.Sprintf("http://%s/readonly_probe", volume)
+			if err := remote_put(remote, int64(len(probe)), bytes.NewReader(probe)); err != nil {
+				continue
+			}
+			remote_delete(remote)
+			a.mlock.Lock()
+			delete(a.readonly, volume)
+			a.db.Delete(readonly2key(volume), nil)
+			a.mlock.Unlock()
+			fmt.Println("volume", volume, "takes writes again")
+		}
+	}
+}
+
+// where the value of the key goes, the best of the volumes that take new values
+// a value already on the best of all the volumes, read-only ones too, stays there
+// the record says if it's erasure coded, a new one has no volumes yet
+func (a *App) KeyVolumes(blob []byte, rec Record) []string {
+	p := a.Policy(blob)
+	count := p.replicas
+	if rec.data != 0 {
+		count = rec.data + rec.parity
+	}
+	kvolumes := key2volume(blob, a.volumes, count, p.subvolumes)
+	if rec.rvolumes != nil && !needs_rebalance(rec.rvolumes, kvolumes) {
+		return kvolumes
+	}
+	return key2volume(blob, a.writable(), count, p.subvolumes)
+}
+
+// how many replicas of the value must be written for a PUT to succeed
+// erasure coded values and the shared blobs of -dedup need all of them
+func (a *App) Quorum(p Policy) int {
+	if a.quorum == 0 || a.quorum > p.replicas {
+		return p.replicas
+	}
+	return a.quorum
+}
+
+// the policy for the key, with the defaults filled in
+// the shared blobs of -dedup have no prefix, they get the defaults
+func (a *App) Policy(blob []byte) Policy {
+	ret := Policy{replicas: a.replicas, subvolumes: a.subvolumes, data: a.data, parity: a.parity, compress: a.compress}
+	if p, ok := key2policy(blob, a.policies); ok {
+		ret.prefix = p.prefix
+		if p.replicas != 0 {
+			ret.replicas = p.replicas
+		}
+		if p.subvolumes != 0 {
+			ret.subvolumes = p.subvolumes
+		}
+		if p.data != 0 {
+			ret.data, ret.parity = p.data, p.parity
+		} else if p.replicas != 0 {
+			// replicas for the prefix, even with -erasure
+			ret.data, ret.parity = 0, 0
+		}
+		if p.compress != "" {
+			ret.compress = p.compress
+		}
+	}
+	if ret.compress == "none" {
+		ret.compress = ""
+	}
+	return ret
+}
@@ -1,14 +1,55 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"os"
 	"strings"
 
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
 	"github.com/syndtr/goleveldb/leveldb/opt"
 )
 
+// the part of a record that rebuild can recover
+func placement(v string) string {
+	if len(v) > 0 && v[0] < ' ' {
+		// versioned record, compare only volumes and the deleted flag
+		var rec struct {
+			Volumes []string `json:"volumes"`
+			Deleted bool     `json:"deleted"`
+		}
+		if err := json.Unmarshal([]byte(v[1:]), &rec); err != nil {
+			panic(fmt.Sprintf("bad record %q: %s", v, err))
+		}
+		ret := strings.Join(rec.Volumes, ",")
+		if rec.Deleted {
+			ret = "DELETED" + ret
+		}
+		return ret
+	}
+	if strings.HasPrefix(v, "HASH") {
+		return v[36:]
+	}
+	return v
+}
+
+// the indexes of expiry, unlinks, repairs and cleanups aren't on the volumes
+// the versions and the shared blobs are
+func recoverable(k []byte) bool {
+	return len(k) == 0 || k[0] != 0 || bytes.HasPrefix(k, []byte("\x00versions")) || bytes.HasPrefix(k, []byte("\x00blobs"))
+}
+
+func next(iter iterator.Iterator) bool {
+	for iter.Next() {
+		if recoverable(iter.Key()) {
+			return true
+		}
+	}
+	return false
+}
+
 func main() {
 	opts := &opt.Options{ErrorIfMissing: true, ReadOnly: true}
 	db1, err1 := leveldb.OpenFile(os.Args[1], opts)
@@ -23,8 +64,8 @@ func main() {
 	iter1 := db1.NewIterator(nil, nil)
 	iter2 := db2.NewIterator(nil, nil)
 	bad := false
-	for iter1.Next() {
-		iter2.Next()
+	for next(iter1) {
+		next(iter2)
 		k1 := string(iter1.Key())
 		v1 := string(iter1.Value())
 		k2 := string(iter2.Key())
@@ -33,12 +74,8 @@ func main() {
 			panic(fmt.Sprintf("key mismatch %s != %s", k1, k2))
 		}
 		// remove the hashes for compare
-		if strings.HasPrefix(v1, "HASH") {
-			v1 = v1[36:]
-		}
-		if strings.HasPrefix(v2, "HASH") {
-			v2 = v2[36:]
-		}
+		v1 = placement(v1)
+		v2 = placement(v2)
 		if v1 != v2 {
 			// we can continue with a value mismatch
 			fmt.Printf("%s: %s != %s\n", k1, v1, v2)
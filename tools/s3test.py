@@ -22,6 +22,17 @@ class TestS3Boto(unittest.TestCase):
     keys = [x['Key'] for x in response['Contents']]
     self.assertIn(key, keys)
 
+  # boto signs the initiate request with the sha256 of its empty body, which isn't the value's
+  def test_multipart(self):
+    key = self.get_fresh_key()
+    mpu = self.s3.create_multipart_upload(Bucket='boto', Key=key, ContentType='text/plain', Metadata={'route': 'r1'})
+    part = self.s3.upload_part(Body=b'hello1', Bucket='boto', Key=key, PartNumber=1, UploadId=mpu['UploadId'])
+    self.s3.complete_multipart_upload(Bucket='boto', Key=key, UploadId=mpu['UploadId'],
+      MultipartUpload={'Parts': [{'ETag': part['ETag'], 'PartNumber': 1}]})
+    response = self.s3.head_object(Bucket='boto', Key=key)
+    self.assertEqual(response['ContentType'], 'text/plain')
+    self.assertEqual(response['Metadata'], {'route': 'r1'})
+
   @unittest.expectedFailure
   def test_writeread(self):
     key = self.get_fresh_key()
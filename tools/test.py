@@ -1,6 +1,7 @@
 #!/usr/bin/env python3
 import os
 import socket
+import base64
 import hashlib
 import binascii
 import unittest
@@ -194,6 +195,136 @@ class TestMiniKeyValue(unittest.TestCase):
       r = requests.head(key, allow_redirects=False)
       self.assertEqual(r.headers['Content-Md5'], hashlib.md5(key).hexdigest())
 
+  def test_content_md5_mismatch(self):
+    key = self.get_fresh_key()
+    r = requests.put(key, data="onyou", headers={"Content-MD5": base64.b64encode(hashlib.md5(b"other").digest())})
+    self.assertEqual(r.status_code, 400)
+
+    r = requests.get(key)
+    self.assertEqual(r.status_code, 404)
+
+    r = requests.put(key, data="onyou", headers={"Content-MD5": base64.b64encode(hashlib.md5(b"onyou").digest())})
+    self.assertEqual(r.status_code, 201)
+
+  def test_chunked_put(self):
+    key = self.get_fresh_key()
+    # a generator is sent without a Content-Length
+    r = requests.put(key, data=(b"onyou" for i in range(1000)))
+    self.assertEqual(r.status_code, 201)
+
+    r = requests.get(key)
+    self.assertEqual(r.status_code, 200)
+    self.assertEqual(r.content, b"onyou"*1000)
+
+  def test_head_headers(self):
+    key = self.get_fresh_key()
+    r = requests.put(key, data="onyou", headers={"Content-Type": "text/plain", "X-Mkv-Meta-Color": "blue"})
+    self.assertEqual(r.status_code, 201)
+    self.assertNotIn("X-Mkv-Version-Id", r.headers)
+
+    r = requests.head(key)
+    self.assertEqual(r.status_code, 200)
+    self.assertEqual(r.headers["Content-Type"], "text/plain")
+    self.assertEqual(r.headers["X-Mkv-Meta-Color"], "blue")
+    self.assertEqual(r.headers["X-Mkv-Size"], "5")
+    self.assertEqual(r.headers["ETag"], '"%s"' % hashlib.md5(b"onyou").hexdigest())
+    self.assertIn("Last-Modified", r.headers)
+    # only a versioned key shows its version
+    self.assertNotIn("X-Mkv-Version-Id", r.headers)
+
+  def test_conditional_put(self):
+    key = self.get_fresh_key()
+    r = requests.put(key, data="onyou", headers={"If-None-Match": "*"})
+    self.assertEqual(r.status_code, 201)
+    r = requests.put(key, data="again", headers={"If-None-Match": "*"})
+    self.assertEqual(r.status_code, 412)
+
+    etag = requests.head(key).headers["ETag"]
+    r = requests.put(key, data="again", headers={"If-Match": '"nope"'})
+    self.assertEqual(r.status_code, 412)
+    r = requests.put(key, data="again", headers={"If-Match": etag})
+    self.assertEqual(r.status_code, 201)
+
+    r = requests.get(key)
+    self.assertEqual(r.status_code, 200)
+    self.assertEqual(r.text, "again")
+
+    # the etag is of the old value now
+    r = requests.put(key, data="more", headers={"If-Match": etag})
+    self.assertEqual(r.status_code, 412)
+
+    r = requests.put(self.get_fresh_key(), data="onyou", headers={"If-Match": "*"})
+    self.assertEqual(r.status_code, 412)
+
+  def test_rebalance_overwritten(self):
+    key = self.get_fresh_key()
+    r = requests.put(key, data="onyou")
+    self.assertEqual(r.status_code, 201)
+    r = requests.put(key, data="again", headers={"If-Match": "*"})
+    self.assertEqual(r.status_code, 201)
+
+    r = requests.request("REBALANCE", key)
+    self.assertEqual(r.status_code, 204)
+
+    r = requests.get(key)
+    self.assertEqual(r.status_code, 200)
+    self.assertEqual(r.text, "again")
+
+    r = requests.request("REBALANCE", self.get_fresh_key())
+    self.assertEqual(r.status_code, 404)
+
+  def test_ttl(self):
+    key = self.get_fresh_key()
+    r = requests.put(key, data="onyou", headers={"X-Mkv-Ttl": "1"})
+    self.assertEqual(r.status_code, 201)
+
+    r = requests.head(key)
+    self.assertEqual(r.status_code, 200)
+    self.assertIn("X-Mkv-Expires", r.headers)
+
+    # gone once it expires, before the reaper deletes it
+    time.sleep(2)
+    r = requests.get(key)
+    self.assertEqual(r.status_code, 404)
+
+    r = requests.put(self.get_fresh_key(), data="onyou", headers={"X-Mkv-Ttl": "soon"})
+    self.assertEqual(r.status_code, 400)
+
+  def test_versions(self):
+    key = self.get_fresh_key()
+    r = requests.put(key, data="one")
+    self.assertEqual(r.status_code, 201)
+    if "X-Mkv-Version-Id" not in r.headers:
+      r = requests.get(key+b"?versions")
+      self.assertEqual(r.json(), {"versions": []})
+      self.skipTest("the server isn't -versioned")
+    v1 = r.headers["X-Mkv-Version-Id"]
+
+    r = requests.put(key, data="two")
+    self.assertEqual(r.status_code, 201)
+    v2 = r.headers["X-Mkv-Version-Id"]
+
+    r = requests.get(key+b"?versions")
+    self.assertEqual(r.status_code, 200)
+    versions = r.json()["versions"]
+    self.assertEqual([v["versionId"] for v in versions], [v1, v2])
+    self.assertEqual([v["latest"] for v in versions], [False, True])
+
+    r = requests.head(key)
+    self.assertEqual(r.headers["X-Mkv-Version-Id"], v2)
+    r = requests.get(key+b"?versionId="+v1.encode())
+    self.assertEqual(r.status_code, 200)
+    self.assertEqual(r.text, "one")
+
+    # a delete leaves the versions
+    r = requests.delete(key)
+    self.assertEqual(r.status_code, 204)
+    r = requests.get(key)
+    self.assertEqual(r.status_code, 404)
+    r = requests.get(key+b"?versionId="+v2.encode())
+    self.assertEqual(r.status_code, 200)
+    self.assertEqual(r.text, "two")
+
 if __name__ == '__main__':
   # wait for servers
   for port in range(3000,3006):